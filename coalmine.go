@@ -3,9 +3,16 @@ package coalmine
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -14,62 +21,757 @@ var (
 	enabledMetric = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "coalmine_feature_enable_total",
-			Help: "Number of times a feature is enabled.",
+			Help: "Number of times a feature is enabled by a matcher or override.",
+		},
+		[]string{"feature", "reason"},
+	)
+	panicMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coalmine_feature_panic_total",
+			Help: "Number of times a feature's matchers panicked during evaluation.",
+		},
+		[]string{"feature"},
+	)
+	observerPanicMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coalmine_observer_panic_total",
+			Help: "Number of times an observer panicked while observing a feature.",
+		},
+		[]string{"feature"},
+	)
+	evaluateDurationMetric = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "coalmine_feature_evaluate_duration_seconds",
+			Help:    "Time spent evaluating a feature's matchers. Only recorded when enabled by SetEvaluationLatencyMetric.",
+			Buckets: prometheus.ExponentialBuckets(1e-7, 4, 10),
+		},
+		[]string{"feature"},
+	)
+	matcherMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coalmine_matcher_evaluate_total",
+			Help: "Number of times each matcher was evaluated by result. Only recorded when enabled by SetMatcherMetric.",
+		},
+		[]string{"feature", "matcher_index", "result"},
+	)
+	timeoutMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coalmine_feature_timeout_total",
+			Help: "Number of times a feature's matchers exceeded the timeout set by WithEvaluationTimeout.",
+		},
+		[]string{"feature"},
+	)
+	circuitBreakerMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "coalmine_circuit_breaker_open",
+			Help: "1 while the circuit breaker set by SetCircuitBreaker is open, disabling every feature.",
+		},
+	)
+	expiryMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "coalmine_feature_expiry_timestamp_seconds",
+			Help: "Unix time at which a feature configured using WithExpiry is disabled. Useful for alerting on features nearing expiry.",
+		},
+		[]string{"feature"},
+	)
+	boundaryMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "coalmine_percentage_boundary_total",
+			Help: "Number of times a WithPercentageBoundaryWarn matcher evaluated a value whose bucket is near its percentage.",
 		},
 		[]string{"feature"},
 	)
 )
 
-var featureNames = sync.Map{}
+// registry holds every feature by lowercased name.
+var registry = sync.Map{}
+
+// aliasRegistry holds features by their lowercased aliases (see WithAlias).
+var aliasRegistry = sync.Map{}
+
+// registryMu serializes registration so names, aliases, and keys can be checked for collisions together.
+var registryMu sync.Mutex
+
+var (
+	evaluationLatencyEnabled int32
+	matcherMetricEnabled     int32
+	circuitBreakerOpen       int32
+	circuitBreakerOverrides  int32
+)
 
 func init() {
-	prometheus.MustRegister(enabledMetric)
+	prometheus.MustRegister(enabledMetric, panicMetric, observerPanicMetric, evaluateDurationMetric, matcherMetric, timeoutMetric, circuitBreakerMetric, expiryMetric, boundaryMetric)
+}
+
+// SetEvaluationLatencyMetric toggles the coalmine_feature_evaluate_duration_seconds histogram.
+// It's disabled by default to avoid the overhead of timing every evaluation.
+func SetEvaluationLatencyMetric(enabled bool) {
+	setFlag(&evaluationLatencyEnabled, enabled)
+}
+
+// SetMatcherMetric toggles the coalmine_matcher_evaluate_total counter, which is labeled by the index
+// of each matcher within its feature's matcher tree (i.e. "1.0" is the first child of the second matcher).
+// It's disabled by default to avoid the overhead and label cardinality.
+func SetMatcherMetric(enabled bool) {
+	setFlag(&matcherMetricEnabled, enabled)
+}
+
+// SetCircuitBreaker disables every feature for the entire process while open, i.e. during a severe incident.
+// It takes precedence over everything else, including overrides unless allowed by SetCircuitBreakerOverrides.
+func SetCircuitBreaker(open bool) {
+	setFlag(&circuitBreakerOpen, open)
+	if open {
+		circuitBreakerMetric.Set(1)
+	} else {
+		circuitBreakerMetric.Set(0)
+	}
+}
+
+// SetCircuitBreakerOverrides allows overrides set on the context (i.e. WithOverride in tests) to take precedence
+// over an open circuit breaker. Disallowed by default.
+func SetCircuitBreakerOverrides(allow bool) {
+	setFlag(&circuitBreakerOverrides, allow)
+}
+
+var environment atomic.Value // string
+
+// SetEnvironment sets the process-wide environment (i.e. "staging") used by WithEnvironment.
+// Intended to be called once at startup.
+func SetEnvironment(env string) {
+	environment.Store(env)
+}
+
+func getEnvironment() string {
+	env, _ := environment.Load().(string)
+	return env
+}
+
+var (
+	hostname     atomic.Value // string
+	hostnameOnce sync.Once
+)
+
+// SetHostname replaces the hostname used by WithHostname, which is otherwise read from os.Hostname. Useful in tests.
+func SetHostname(name string) {
+	hostnameOnce.Do(func() {})
+	hostname.Store(name)
+}
+
+func getHostname() string {
+	hostnameOnce.Do(func() {
+		name, _ := os.Hostname()
+		hostname.Store(name)
+	})
+	return hostname.Load().(string)
 }
 
+func setFlag(flag *int32, enabled bool) {
+	var val int32
+	if enabled {
+		val = 1
+	}
+	atomic.StoreInt32(flag, val)
+}
+
+func getFlag(flag *int32) bool { return atomic.LoadInt32(flag) == 1 }
+
 // Feature represents a unit of functionality that can be enabled and disabled.
 type Feature struct {
-	name     string
-	matchers []*matcher
+	enables uint64 // enables counted by countEnable, first for 64 bit alignment on 32 bit platforms
+
+	name           string
+	gate           *matcher     // prerequisite set by groups and splits
+	matchers       atomic.Value // []*matcher, replaced by SetMatchers
+	disabled       bool
+	defaultEnabled bool
+	expiry         time.Time
+	metricSampled  bool
+	metricRate     float64 // see WithMetricSampling
+	aliases        []string
+	overrideKeys   []interface{} // context keys for the name and aliases, boxed once to avoid allocating during evaluation
 }
 
 // NewFeature allocates a new Feature using the provided matcher options.
 func NewFeature(name string, opts ...MatcherOption) *Feature {
-	if _, ok := featureNames.LoadOrStore(strings.ToLower(name), struct{}{}); ok {
-		panic(fmt.Errorf("a coalmine feature with the name %q already exists", name))
-	}
 	f := &Feature{
 		name: name,
 	}
+	f.matchers.Store(buildMatchers(f, opts))
+	f.register()
+	return f
+}
+
+// register adds the feature to the registry, panicking if the name or one of its aliases is taken.
+func (f *Feature) register() {
+	names := append([]string{f.name}, f.aliases...)
+	for _, name := range names {
+		f.overrideKeys = append(f.overrideKeys, newFeatureKey(name))
+	}
+
+	registryMu.Lock()
+	seen := map[string]struct{}{}
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if _, ok := definedKeys.Load(lower); ok {
+			registryMu.Unlock()
+			panic(fmt.Errorf("a coalmine key with the name %q already exists", name))
+		}
+		if _, ok := seen[lower]; ok || lookupFeature(name) != nil {
+			registryMu.Unlock()
+			panic(fmt.Errorf("a coalmine feature with the name %q already exists", name))
+		}
+		seen[lower] = struct{}{}
+	}
+	registry.Store(strings.ToLower(f.name), f)
+	for _, alias := range f.aliases {
+		aliasRegistry.Store(strings.ToLower(alias), f)
+	}
+	registryMu.Unlock()
+
+	if !f.expiry.IsZero() {
+		expiryMetric.WithLabelValues(f.name).Set(float64(f.expiry.Unix()))
+	}
+	f.publishExpvar()
+}
+
+// Clone allocates a new feature with a copy of f's matchers, prerequisites, and configuration under a different name.
+// Useful for creating per-tenant variants of the same rules. Aliases are not copied since they refer to f.
+// The clone is independent of f: calling SetMatchers on one does not affect the other.
+// Panics if the name is taken.
+func (f *Feature) Clone(name string) *Feature {
+	c := &Feature{
+		name:           name,
+		disabled:       f.disabled,
+		defaultEnabled: f.defaultEnabled,
+		expiry:         f.expiry,
+		metricSampled:  f.metricSampled,
+		metricRate:     f.metricRate,
+	}
+	if f.gate != nil {
+		c.gate = f.gate.clone()
+		c.gate.setIndex(name, "gate")
+	}
+	var matchers []*matcher
+	for i, m := range f.getMatchers() {
+		m = m.clone()
+		m.setIndex(name, strconv.Itoa(i))
+		matchers = append(matchers, m)
+	}
+	c.matchers.Store(matchers)
+	c.register()
+	return c
+}
+
+var globalOverrides = sync.Map{}
+
+// SetGlobalOverride forces the given feature to be either enabled or disabled for the entire process,
+// without needing a context. Intended for operations and tests. Overrides set on the context (i.e. WithOverride)
+// take precedence.
+func SetGlobalOverride(feature *Feature, enable bool) {
+	globalOverrides.Store(feature, enable)
+}
+
+// ClearGlobalOverride removes any override set by SetGlobalOverride.
+func ClearGlobalOverride(feature *Feature) {
+	globalOverrides.Delete(feature)
+}
+
+// ForceEnable enables the feature for the entire process until ClearForce is called, i.e. from an admin endpoint.
+// Shorthand for SetGlobalOverride, so overrides set on the context still take precedence.
+func (f *Feature) ForceEnable() { SetGlobalOverride(f, true) }
+
+// ForceDisable disables the feature for the entire process until ClearForce is called.
+// Shorthand for SetGlobalOverride, so overrides set on the context still take precedence.
+func (f *Feature) ForceDisable() { SetGlobalOverride(f, false) }
+
+// ClearForce removes any state set by ForceEnable, ForceDisable, or SetGlobalOverride.
+func (f *Feature) ClearForce() { ClearGlobalOverride(f) }
+
+func buildMatchers(f *Feature, opts []MatcherOption) []*matcher {
+	var matchers []*matcher
 	for _, opt := range opts {
 		m := opt(f)
 		if m != nil {
-			f.matchers = append(f.matchers, m)
+			m.setIndex(f.name, strconv.Itoa(len(matchers)))
+			matchers = append(matchers, m)
 		}
 	}
-	return f
+	return matchers
+}
+
+func (f *Feature) getMatchers() []*matcher {
+	matchers, _ := f.matchers.Load().([]*matcher)
+	return matchers
+}
+
+// SetMatchers atomically replaces the feature's matchers, e.g. to apply rules pushed from configuration at runtime.
+// Concurrent evaluations see either the old or the new matchers, never a mix of both.
+// Options that configure the feature rather than matching (i.e. WithDisabled, WithAlias) are ignored.
+// Only the feature's own matchers are replaced, so prerequisites set by groups and splits keep applying.
+// A split feature is no longer enabled for its entire share of values, just the part of it that the new matchers match.
+func (f *Feature) SetMatchers(opts ...MatcherOption) {
+	f.matchers.Store(buildMatchers(&Feature{name: f.name}, opts))
+}
+
+// addGate adds a prerequisite that must match before the feature's matchers are evaluated.
+func (f *Feature) addGate(m *matcher) {
+	if f.gate != nil {
+		m = &matcher{op: opAND, matchers: []*matcher{f.gate, m}}
+	}
+	m.setIndex(f.name, "gate")
+	f.gate = m
+}
+
+// EnabledByName evaluates the feature with the given (case-insensitive) name or alias.
+// The second return value is false when no such feature exists.
+func EnabledByName(ctx context.Context, name string) (state bool, found bool) {
+	f := lookupFeature(name)
+	if f == nil {
+		return false, false
+	}
+	return f.Enabled(ctx), true
+}
+
+// lookupFeature returns the feature with the given name or alias, or nil if there isn't one.
+func lookupFeature(name string) *Feature {
+	val, ok := registry.Load(strings.ToLower(name))
+	if !ok {
+		val, ok = aliasRegistry.Load(strings.ToLower(name))
+	}
+	if !ok {
+		return nil
+	}
+	return val.(*Feature)
+}
+
+// SnapshotAll evaluates every feature given the current context, returning the results by feature name.
+// Observers are called for each feature. Useful for debug endpoints.
+func SnapshotAll(ctx context.Context) map[string]bool {
+	snapshot := map[string]bool{}
+	registry.Range(func(key, value interface{}) bool {
+		f := value.(*Feature)
+		snapshot[f.name] = f.Enabled(ctx)
+		return true
+	})
+	return snapshot
+}
+
+// FeatureInfo describes the definition of a registered feature. See Registry.
+type FeatureInfo struct {
+	Name           string          `json:"name"`
+	Aliases        []string        `json:"aliases,omitempty"`
+	Disabled       bool            `json:"disabled"`
+	DefaultEnabled bool            `json:"default_enabled"`
+	Expiry         *time.Time      `json:"expiry,omitempty"`
+	Gate           json.RawMessage `json:"gate,omitempty"` // prerequisite set by groups and splits
+	Matchers       json.RawMessage `json:"matchers"`
+	Keys           []Key           `json:"keys"`
+}
+
+// Registry describes every registered feature, sorted by name. Features are not evaluated.
+// Useful for admin APIs and generating documentation of all features.
+func Registry() []FeatureInfo {
+	var infos []FeatureInfo
+	registry.Range(func(key, value interface{}) bool {
+		infos = append(infos, value.(*Feature).info())
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (f *Feature) info() FeatureInfo {
+	info := FeatureInfo{
+		Name:           f.name,
+		Aliases:        f.aliases,
+		Disabled:       f.disabled,
+		DefaultEnabled: f.defaultEnabled,
+		Keys:           f.Keys(),
+	}
+	if !f.expiry.IsZero() {
+		expiry := f.expiry
+		info.Expiry = &expiry
+	}
+	// Marshaling can't fail since matcherInfo only holds JSON-safe values
+	if f.gate != nil {
+		info.Gate, _ = json.Marshal(f.gate.describe())
+	}
+	matchers := []*matcherInfo{}
+	for _, m := range f.getMatchers() {
+		matchers = append(matchers, m.describe())
+	}
+	info.Matchers, _ = json.Marshal(matchers)
+	return info
 }
 
 // Enabled returns true if the feature should be enabled given the current context.
-func (f *Feature) Enabled(ctx context.Context) (ok bool) {
-	observer := getObserver(ctx)
-	if observer != nil {
+// Matchers that panic are recovered and the feature is considered disabled.
+func (f *Feature) Enabled(ctx context.Context) bool {
+	return f.EnabledOr(ctx, false)
+}
+
+// EnabledOr is identical to Enabled except fallback is returned when a matcher panics.
+func (f *Feature) EnabledOr(ctx context.Context, fallback bool) bool {
+	var tracker *keyTracker
+	if getStrictKeysFunc(ctx) != nil {
+		tracker = &keyTracker{}
+		ctx = context.WithValue(ctx, keyTrackerKey{}, tracker)
+	}
+	var detail *string
+	if getDecisionSink(ctx) != nil {
+		detail = new(string)
+		ctx = context.WithValue(ctx, detailKey{}, detail)
+	}
+	d := f.decide(ctx, fallback)
+	if detail != nil && d.Reason != ReasonMatcher {
+		d.Detail = *detail
+	}
+	if tracker != nil && len(tracker.missing) > 0 {
+		getStrictKeysFunc(ctx)(f.name, tracker.missing)
+	}
+	if d.State {
+		switch d.Reason {
+		case ReasonMatcher, ReasonOverride, ReasonGlobalOverride, ReasonOverrideLoop:
+			f.countEnable(d.Reason)
+		}
+	}
+	if sink := getDecisionSink(ctx); sink != nil {
+		*sink = d
+	}
+	audit(ctx, d)
+	if hook := getMetricsHook(ctx); hook != nil {
+		hook(f.name, d.State, d.Reason)
+	}
+	if observer := getObserver(ctx); observer != nil {
+		f.observe(ctx, observer, d.State)
+	}
+	if isDryRun(ctx) {
+		return false
+	}
+	return d.State
+}
+
+// countEnable increments the enable counter, sampling if configured by WithMetricSampling.
+func (f *Feature) countEnable(reason Reason) {
+	n := atomic.AddUint64(&f.enables, 1)
+	if !f.metricSampled {
+		enabledMetric.WithLabelValues(f.name, string(reason)).Inc()
+		return
+	}
+	if f.metricRate <= 0 {
+		return
+	}
+	// Sample deterministically, scaling each sampled increment so the counter still approximates the total
+	if uint64(float64(n)*f.metricRate) != uint64(float64(n-1)*f.metricRate) {
+		enabledMetric.WithLabelValues(f.name, string(reason)).Add(1 / f.metricRate)
+	}
+}
+
+// observe calls the observer, recovering from any panics since observers should never break evaluation.
+func (f *Feature) observe(ctx context.Context, observer ObserverFunc, state bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			observerPanicMetric.WithLabelValues(f.name).Inc()
+		}
+	}()
+	observer(ctx, f.name, state)
+}
+
+// Probe evaluates the feature identically to Enabled but is a pure read, for health checks and admin previews.
+// No metrics are recorded, observers, metrics hooks, decision sinks, and audit functions aren't called,
+// the evaluation cache is bypassed, and assignments made by WithStickyPercentage aren't stored.
+func (f *Feature) Probe(ctx context.Context) bool {
+	d := f.decide(withProbe(ctx), false)
+	if isDryRun(ctx) {
+		return false
+	}
+	return d.State
+}
+
+// ErrMissingKey is returned by EnabledStrict when a matcher references a key that hasn't been set.
+var ErrMissingKey = errors.New("a coalmine matcher referenced a key that has not been set")
+
+// EnabledStrict is identical to Enabled except an error wrapping ErrMissingKey is returned when
+// the feature's matchers examined keys that haven't been set on the context. The state is still returned.
+func (f *Feature) EnabledStrict(ctx context.Context) (bool, error) {
+	var missing []Key
+	ctx = WithStrictKeys(ctx, func(feature string, keys []Key) {
+		missing = keys
+	})
+	state := f.Enabled(ctx)
+	if len(missing) == 0 {
+		return state, nil
+	}
+	names := make([]string, len(missing))
+	for i, key := range missing {
+		names[i] = string(key)
+	}
+	return state, fmt.Errorf("%w: %s", ErrMissingKey, strings.Join(names, ", "))
+}
+
+// Keys returns the distinct context keys referenced by the feature's matchers.
+// Useful for validating that every required value has been set.
+func (f *Feature) Keys() []Key {
+	var keys []Key
+	seen := map[valueKey]struct{}{}
+	if f.gate != nil {
+		keys = f.gate.appendKeys(keys, seen)
+	}
+	for _, m := range f.getMatchers() {
+		keys = m.appendKeys(keys, seen)
+	}
+	return keys
+}
+
+// Preview evaluates the feature once for each of the given values of key, returning the results by value.
+// Useful for validating cohort selection before rolling out. Values are evaluated using Probe, so previews have no side effects.
+func (f *Feature) Preview(ctx context.Context, key Key, values []string) map[string]bool {
+	results := make(map[string]bool, len(values))
+	for _, value := range values {
+		results[value] = f.Probe(WithValue(ctx, key, value))
+	}
+	return results
+}
+
+func (f *Feature) decide(ctx context.Context, fallback bool) Decision {
+	d := Decision{Feature: f.name, Matcher: -1}
+	breakerOpen := getFlag(&circuitBreakerOpen)
+	if breakerOpen && !getFlag(&circuitBreakerOverrides) {
+		d.Reason = ReasonCircuitBreaker
+		return d
+	}
+	if enabled, present := f.getOverride(ctx); present {
+		d.State, d.Reason = enabled, ReasonOverride
+		return d
+	}
+	if breakerOpen {
+		d.Reason = ReasonCircuitBreaker
+		return d
+	}
+	if val, present := globalOverrides.Load(f); present {
+		d.State, d.Reason = val.(bool), ReasonGlobalOverride
+		return d
+	}
+	if enabled, present := f.getLoopOverride(ctx); present {
+		d.State, d.Reason = enabled, ReasonOverrideLoop
+		return d
+	}
+	if f.disabled {
+		d.Reason = ReasonDisabled
+		return d
+	}
+	if !f.expiry.IsZero() && !now().Before(f.expiry) {
+		d.Reason = ReasonExpired
+		return d
+	}
+	if len(f.getMatchers()) == 0 && f.gate == nil {
+		d.State, d.Reason = f.defaultEnabled, ReasonDefault
+		return d
+	}
+	i, panicked := f.safeMatch(ctx)
+	if panicked {
+		d.State, d.Reason = fallback, ReasonPanic
+		return d
+	}
+	if i == gateClosed {
+		d.Reason = ReasonGate
+		return d
+	}
+	if i >= 0 {
+		d.State, d.Reason, d.Matcher = true, ReasonMatcher, i
+		return d
+	}
+	d.State, d.Reason = f.defaultEnabled, ReasonDefault
+	return d
+}
+
+// safeMatch is identical to match but recovers from panicking matchers.
+func (f *Feature) safeMatch(ctx context.Context) (i int, panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if !isProbe(ctx) {
+				panicMetric.WithLabelValues(f.name).Inc()
+			}
+			i, panicked = -1, true
+		}
+	}()
+	return f.match(ctx), false
+}
+
+// match returns the index of the first matcher that matches, or -1 if none do.
+// The context's evaluation cache is used when present, except by Probe.
+func (f *Feature) match(ctx context.Context) int {
+	cache := getEvaluationCache(ctx)
+	if cache == nil || isProbe(ctx) {
+		i, _ := f.evaluateBounded(ctx)
+		return i
+	}
+	if i, present := cache.load(f); present {
+		return i
+	}
+	i, timedOut := f.evaluateBounded(ctx)
+	if !timedOut {
+		cache.store(f, i)
+	}
+	return i
+}
+
+// evaluateBounded is identical to evaluate but gives up once the timeout set by WithEvaluationTimeout elapses.
+// Matchers keep running in the background after a timeout, so they're given their own key tracker and detail
+// which are only merged into the caller's once evaluation completes.
+func (f *Feature) evaluateBounded(ctx context.Context) (i int, timedOut bool) {
+	timeout := getEvaluationTimeout(ctx)
+	if timeout <= 0 {
+		return f.evaluate(ctx), false
+	}
+	inner, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tracker, innerTracker := getKeyTracker(ctx), &keyTracker{}
+	if tracker != nil {
+		inner = context.WithValue(inner, keyTrackerKey{}, innerTracker)
+	}
+	detail, _ := ctx.Value(detailKey{}).(*string)
+	innerDetail := new(string)
+	if detail != nil {
+		inner = context.WithValue(inner, detailKey{}, innerDetail)
+	}
+
+	type result struct {
+		i        int
+		panicked interface{}
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{i: -1, panicked: r}
+			}
+		}()
+		done <- result{i: f.evaluate(inner)}
+	}()
+
+	select {
+	case r := <-done:
+		if r.panicked != nil {
+			panic(r.panicked) // recovered by safeMatch
+		}
+		if tracker != nil {
+			for _, key := range innerTracker.missing {
+				tracker.add(key)
+			}
+		}
+		if detail != nil {
+			*detail = *innerDetail
+		}
+		return r.i, false
+	case <-inner.Done():
+		if !isProbe(ctx) {
+			timeoutMetric.WithLabelValues(f.name).Inc()
+		}
+		return -1, true
+	}
+}
+
+func (f *Feature) evaluate(ctx context.Context) int {
+	if getFlag(&evaluationLatencyEnabled) && !isProbe(ctx) {
+		start := time.Now()
 		defer func() {
-			observer(ctx, f.name, ok)
+			evaluateDurationMetric.WithLabelValues(f.name).Observe(time.Since(start).Seconds())
 		}()
 	}
-	if enabled, present := getOverride(ctx, f.name); present {
-		ok = enabled
-		return ok
+	if f.gate != nil && !f.gate.evaluate(ctx) {
+		return gateClosed
 	}
-	for _, matcher := range f.matchers {
+	for i, matcher := range f.getMatchers() {
 		if matcher.evaluate(ctx) {
-			enabledMetric.WithLabelValues(f.name).Inc()
-			ok = true
-			return ok
+			return i
+		}
+	}
+	return -1
+}
+
+// gateClosed is returned by evaluate when the feature's gate didn't match.
+const gateClosed = -2
+
+func (f *Feature) getOverride(ctx context.Context) (bool /* state */, bool /* present */) {
+	for _, key := range f.overrideKeys {
+		if enabled, present := getOverride(ctx, key); present {
+			return enabled, present
+		}
+	}
+	for _, override := range getPrefixOverrides(ctx) {
+		for _, key := range f.overrideKeys {
+			if strings.HasPrefix(string(key.(featureKey)), override.prefix) {
+				return override.enable, true
+			}
+		}
+	}
+	return false, false
+}
+
+// Reason describes what determined a feature's state.
+type Reason string
+
+const (
+	// ReasonDefault means no matcher matched the context. See WithDefaultEnabled.
+	ReasonDefault Reason = "default"
+	// ReasonCircuitBreaker means every feature was disabled by SetCircuitBreaker.
+	ReasonCircuitBreaker Reason = "circuit_breaker"
+	// ReasonOverride means the state was forced by an override.
+	ReasonOverride Reason = "override"
+	// ReasonGlobalOverride means the state was forced by SetGlobalOverride.
+	ReasonGlobalOverride Reason = "global_override"
+	// ReasonOverrideLoop means the state was forced by an OverrideLoop.
+	ReasonOverrideLoop Reason = "override_loop"
+	// ReasonDisabled means the feature was configured using WithDisabled.
+	ReasonDisabled Reason = "disabled"
+	// ReasonExpired means the feature's expiry (see WithExpiry) has passed.
+	ReasonExpired Reason = "expired"
+	// ReasonMatcher means one of the feature's matchers matched the context.
+	ReasonMatcher Reason = "matcher"
+	// ReasonGate means the context didn't meet a prerequisite of the feature (see Group and Split).
+	ReasonGate Reason = "gate"
+	// ReasonPanic means a matcher panicked and the fallback state was used.
+	ReasonPanic Reason = "panic"
+)
+
+// Decision records the outcome of a feature evaluation. See WithDecisionSink.
+type Decision struct {
+	Feature string
+	State   bool
+	Reason  Reason
+	Matcher int    // index of the matching matcher, -1 if none matched (options like WithDisabled are not counted)
+	Detail  string // explanation of the most recent miss reported by a matcher (see WithValueOneOf), empty if a matcher matched
+}
+
+func (f *Feature) getLoopOverride(ctx context.Context) (bool /* state */, bool /* present */) {
+	loop := getOverrideLoop(ctx)
+	if loop == nil {
+		return false, false
+	}
+	for _, key := range f.overrideKeys {
+		if enabled, present := loop.get(key.(featureKey)); present {
+			return enabled, present
 		}
 	}
-	return ok
+	return false, false
 }
 
 // Key is a case-insensitive string key for context values used by coalmine.
 type Key string
+
+// definedKeys holds the lowercased names of keys created by DefineKey.
+var definedKeys = sync.Map{}
+
+// DefineKey returns a Key after checking that its name doesn't collide with a feature name or alias.
+// Like NewFeature, it panics on collisions, and features created afterwards can't reuse the name.
+func DefineKey(name string) Key {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if lookupFeature(name) != nil {
+		panic(fmt.Errorf("a coalmine feature with the name %q already exists", name))
+	}
+	definedKeys.Store(strings.ToLower(name), struct{}{})
+	return Key(name)
+}
@@ -1,10 +1,25 @@
 package coalmine
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"hash/fnv"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	texttemplate "text/template"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -38,167 +53,3033 @@ func TestFeatureExactMatch(t *testing.T) {
 	})
 }
 
-func TestFeaturePercentage(t *testing.T) {
+func TestFeatureExactMatchFold(t *testing.T) {
 	ctx := context.Background()
-	key := Key("test-key")
-	f := NewFeature(t.Name(), WithPercentage(key, 50))
+	key := Key("region")
+	strict := NewFeature(t.Name()+"Strict", WithExactMatch(key, "westus"))
+	fold := NewFeature(t.Name()+"Fold", WithExactMatchFold(key, "westus"))
 
-	t.Run("positive", func(t *testing.T) {
-		ctx := WithValue(ctx, key, "1")
-		assert.True(t, f.Enabled(ctx))
+	t.Run("same casing", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "westus")
+		assert.True(t, strict.Enabled(ctx))
+		assert.True(t, fold.Enabled(ctx))
 	})
 
-	t.Run("wrong casing", func(t *testing.T) {
-		ctx := WithValue(ctx, Key("TEST-KEY"), "1")
-		assert.True(t, f.Enabled(ctx))
+	t.Run("different casing", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "WestUS")
+		assert.False(t, strict.Enabled(ctx))
+		assert.True(t, fold.Enabled(ctx))
 	})
 
-	t.Run("negative", func(t *testing.T) {
-		ctx := WithValue(ctx, key, "3")
+	t.Run("wrong value", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "eastus")
+		assert.False(t, strict.Enabled(ctx))
+		assert.False(t, fold.Enabled(ctx))
+	})
+}
+
+func TestFeatureValueNormalizer(t *testing.T) {
+	ctx := WithValueNormalizer(context.Background(), strings.ToLower)
+	key := Key("region")
+	f := NewFeature(t.Name(), WithExactMatch(key, "westus"))
+
+	for _, value := range []string{"westus", "WestUS", "WESTUS"} {
+		t.Run(value, func(t *testing.T) {
+			ctx := WithValue(ctx, key, value)
+			assert.True(t, f.Enabled(ctx))
+		})
+	}
+
+	t.Run("without normalizer", func(t *testing.T) {
+		ctx := WithValue(context.Background(), key, "WestUS")
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("wrong value", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "EastUS")
 		assert.False(t, f.Enabled(ctx))
 	})
 }
 
-func TestFeatureMatchOR(t *testing.T) {
+func TestFeatureExactMatchAny(t *testing.T) {
 	ctx := context.Background()
-	key, value, value2 := Key("test-key"), "test-value", "test-value-2"
-	f := NewFeature(t.Name(), WithExactMatch(key, value), WithExactMatch(key, value2))
+	key, key2, value := Key("test-key"), Key("test-key-2"), "test-value"
+	f := NewFeature(t.Name(), WithExactMatchAny(value, key, key2))
 
-	t.Run("first", func(t *testing.T) {
+	t.Run("first key", func(t *testing.T) {
 		ctx := WithValue(ctx, key, value)
 		assert.True(t, f.Enabled(ctx))
 	})
 
-	t.Run("second", func(t *testing.T) {
-		ctx := WithValue(ctx, key, value2)
+	t.Run("second key", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "wrong value")
+		ctx = WithValue(ctx, key2, value)
 		assert.True(t, f.Enabled(ctx))
 	})
 
-	t.Run("both", func(t *testing.T) {
-		ctx := WithValue(ctx, key, value)
-		ctx = WithValue(ctx, key, value2)
+	t.Run("wrong values", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "wrong value")
+		ctx = WithValue(ctx, key2, "wrong value")
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("missing values", func(t *testing.T) {
+		assert.False(t, f.Enabled(ctx))
+	})
+}
+
+func TestFeatureValueOneOf(t *testing.T) {
+	ctx := context.Background()
+	key := Key("region")
+	f := NewFeature(t.Name(), WithValueOneOf(key, "westus", "eastus"))
+
+	t.Run("match", func(t *testing.T) {
+		d := &Decision{}
+		ctx := WithDecisionSink(WithValue(ctx, key, "eastus"), d)
 		assert.True(t, f.Enabled(ctx))
+		assert.Empty(t, d.Detail)
 	})
 
-	t.Run("neither", func(t *testing.T) {
+	t.Run("wrong value", func(t *testing.T) {
+		d := &Decision{}
+		ctx := WithDecisionSink(WithValue(ctx, key, "centralus"), d)
+		assert.False(t, f.Enabled(ctx))
+		assert.Equal(t, `value "centralus" of key "region" is not one of the expected values`, d.Detail)
+	})
+
+	t.Run("absent", func(t *testing.T) {
+		d := &Decision{}
+		ctx := WithDecisionSink(ctx, d)
+		assert.False(t, f.Enabled(ctx))
+		assert.Equal(t, `key "region" is not set`, d.Detail)
+
+		state, err := f.EnabledStrict(ctx)
+		assert.False(t, state)
+		assert.True(t, errors.Is(err, ErrMissingKey))
+	})
+
+	t.Run("set to empty", func(t *testing.T) {
+		d := &Decision{}
+		ctx := WithDecisionSink(WithValue(ctx, key, ""), d)
 		assert.False(t, f.Enabled(ctx))
+		assert.Equal(t, `value "" of key "region" is not one of the expected values`, d.Detail)
+	})
+
+	t.Run("later matcher matches", func(t *testing.T) {
+		f := NewFeature(t.Name(), WithValueOneOf(key, "westus"), WithExactMatch(Key("tier"), "gold"))
+		d := &Decision{}
+		ctx := WithDecisionSink(WithValue(ctx, Key("tier"), "gold"), d)
+		assert.True(t, f.Enabled(ctx))
+		assert.Equal(t, ReasonMatcher, d.Reason)
+		assert.Empty(t, d.Detail)
 	})
 }
 
-func TestFeatureMatchAND(t *testing.T) {
+func TestFeatureListContains(t *testing.T) {
 	ctx := context.Background()
-	key, key2, value, value2 := Key("test-key"), Key("test-key-2"), "test-value", "test-value-2"
-	f := NewFeature(t.Name(), WithAND(WithExactMatch(key, value), WithExactMatch(key2, value2)))
+	key := Key("groups")
+	f := NewFeature(t.Name(), WithListContains(key, "beta", ","))
 
-	t.Run("first", func(t *testing.T) {
-		ctx := WithValue(ctx, key, value)
+	t.Run("present", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "alpha, beta ,gamma")
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("single item", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "beta")
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("absent", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "alpha,betamax")
 		assert.False(t, f.Enabled(ctx))
 	})
 
-	t.Run("second", func(t *testing.T) {
-		ctx := WithValue(ctx, key2, value2)
+	t.Run("empty list", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "")
 		assert.False(t, f.Enabled(ctx))
 	})
 
-	t.Run("both", func(t *testing.T) {
-		ctx := WithValue(ctx, key, value)
-		ctx = WithValue(ctx, key2, value2)
+	t.Run("custom separator", func(t *testing.T) {
+		f := NewFeature(t.Name(), WithListContains(key, "beta", "|"))
+		assert.True(t, f.Enabled(WithValue(ctx, key, "alpha|beta")))
+		assert.False(t, f.Enabled(WithValue(ctx, key, "alpha,beta")))
+	})
+}
+
+func TestFeatureSliceContains(t *testing.T) {
+	ctx := context.Background()
+	key := Key("roles")
+	f := NewFeature(t.Name(), WithSliceContains(key, "admin"))
+
+	t.Run("member", func(t *testing.T) {
+		ctx := WithSliceValue(ctx, Key("ROLES"), []string{"viewer", "admin"})
 		assert.True(t, f.Enabled(ctx))
 	})
 
-	t.Run("neither", func(t *testing.T) {
+	t.Run("not a member", func(t *testing.T) {
+		ctx := WithSliceValue(ctx, key, []string{"viewer", "Admin"})
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("empty slice", func(t *testing.T) {
+		ctx := WithSliceValue(ctx, key, []string{})
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("unset", func(t *testing.T) {
+		assert.False(t, f.Enabled(ctx))
+
+		_, err := f.EnabledStrict(ctx)
+		assert.True(t, errors.Is(err, ErrMissingKey))
+		_, err = f.EnabledStrict(WithSliceValue(ctx, key, nil))
+		assert.NoError(t, err)
+	})
+
+	t.Run("string value ignored", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "admin")
 		assert.False(t, f.Enabled(ctx))
 	})
+
+	t.Run("copied", func(t *testing.T) {
+		roles := []string{"admin"}
+		ctx := WithSliceValue(ctx, key, roles)
+		roles[0] = "viewer"
+		assert.True(t, f.Enabled(ctx))
+	})
 }
 
-func TestFeatureOverride(t *testing.T) {
+func TestFeatureValueFunc(t *testing.T) {
 	ctx := context.Background()
-	key, value := Key("test-key"), "test-value"
-	f := NewFeature(t.Name(), WithExactMatch(key, value))
+	key := Key("test-key")
+	f := NewFeature(t.Name(), WithValueFunc(key, func(value string) bool {
+		_, err := strconv.Atoi(value)
+		return err == nil
+	}))
 
-	t.Run("feature on, override off", func(t *testing.T) {
-		ctx := WithValue(ctx, key, value)
-		ctx = WithOverride(ctx, f, false)
+	t.Run("positive", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "123")
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "abc")
 		assert.False(t, f.Enabled(ctx))
 	})
 
-	t.Run("feature on, override on", func(t *testing.T) {
-		ctx := WithValue(ctx, key, value)
-		ctx = WithOverride(ctx, f, true)
+	t.Run("missing value", func(t *testing.T) {
+		assert.False(t, f.Enabled(ctx))
+	})
+}
+
+func TestFeatureKeyPresence(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	present := NewFeature(t.Name()+"Present", WithKeyPresent(key))
+	absent := NewFeature(t.Name()+"Absent", WithKeyAbsent(key))
+
+	t.Run("set but empty", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "")
+		assert.True(t, present.Enabled(ctx))
+		assert.False(t, absent.Enabled(ctx))
+	})
+
+	t.Run("set", func(t *testing.T) {
+		ctx := WithValue(ctx, Key("TEST-KEY"), "test-value")
+		assert.True(t, present.Enabled(ctx))
+		assert.False(t, absent.Enabled(ctx))
+	})
+
+	t.Run("set with WithValues", func(t *testing.T) {
+		ctx := WithValues(ctx, map[Key]string{key: ""})
+		assert.True(t, present.Enabled(ctx))
+		assert.False(t, absent.Enabled(ctx))
+	})
+
+	t.Run("unset", func(t *testing.T) {
+		assert.False(t, present.Enabled(ctx))
+		assert.True(t, absent.Enabled(ctx))
+	})
+}
+
+type mapValueProvider map[string]string
+
+func (m mapValueProvider) Value(key Key) (string, bool) {
+	val, ok := m[strings.ToLower(string(key))]
+	return val, ok
+}
+
+func TestFeatureValueProvider(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	f := NewFeature(t.Name(), WithExactMatch(key, "test-value"))
+	present := NewFeature(t.Name()+"Present", WithKeyPresent(key))
+	ctx = WithValueProvider(ctx, mapValueProvider{"test-key": "test-value"})
+
+	t.Run("provided", func(t *testing.T) {
 		assert.True(t, f.Enabled(ctx))
+		assert.True(t, present.Enabled(ctx))
 	})
 
-	t.Run("feature off, override off", func(t *testing.T) {
-		ctx := WithOverride(ctx, f, false)
+	t.Run("direct value takes precedence", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "other-value")
 		assert.False(t, f.Enabled(ctx))
 	})
 
-	t.Run("feature off, override on", func(t *testing.T) {
-		ctx := WithOverride(ctx, f, true)
+	t.Run("normalized", func(t *testing.T) {
+		ctx := WithValueNormalizer(WithValueProvider(ctx, mapValueProvider{"test-key": "TEST-VALUE"}), strings.ToLower)
 		assert.True(t, f.Enabled(ctx))
 	})
 
-	t.Run("prove other feature not matched", func(t *testing.T) {
-		ctx := WithOverride(ctx, f, true)
+	t.Run("missing", func(t *testing.T) {
+		ctx := WithValueProvider(ctx, mapValueProvider{})
+		assert.False(t, f.Enabled(ctx))
+		assert.False(t, present.Enabled(ctx))
+		_, err := f.EnabledStrict(ctx)
+		assert.ErrorIs(t, err, ErrMissingKey)
+	})
+}
 
-		f2 := NewFeature("some other feature")
-		assert.False(t, f2.Enabled(ctx))
+func TestFeatureBoolValue(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	isTrue := NewFeature(t.Name()+"True", WithBoolTrue(key))
+	isFalse := NewFeature(t.Name()+"False", WithBoolFalse(key))
+
+	t.Run("true", func(t *testing.T) {
+		ctx := WithBoolValue(ctx, Key("TEST-KEY"), true)
+		assert.True(t, isTrue.Enabled(ctx))
+		assert.False(t, isFalse.Enabled(ctx))
+	})
+
+	t.Run("false", func(t *testing.T) {
+		ctx := WithBoolValue(ctx, key, false)
+		assert.False(t, isTrue.Enabled(ctx))
+		assert.True(t, isFalse.Enabled(ctx))
+	})
+
+	t.Run("unset", func(t *testing.T) {
+		assert.False(t, isTrue.Enabled(ctx))
+		assert.True(t, isFalse.Enabled(ctx))
+
+		state, err := isFalse.EnabledStrict(ctx)
+		assert.True(t, state)
+		assert.True(t, errors.Is(err, ErrMissingKey))
+		_, err = isTrue.EnabledStrict(WithBoolValue(ctx, key, false))
+		assert.NoError(t, err)
+	})
+
+	t.Run("string value ignored", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "true")
+		assert.False(t, isTrue.Enabled(ctx))
 	})
 }
 
-func TestFeatureOverrideString(t *testing.T) {
+func TestFeatureEnvironment(t *testing.T) {
 	ctx := context.Background()
+	f := NewFeature(t.Name(), WithEnvironment("dev", "Staging"))
+	defer SetEnvironment("")
 
-	t.Run("positive", func(t *testing.T) {
-		f := NewFeature(t.Name())
-		ctx := WithOverrideString(ctx, "Foo", "Foo1,Foo"+t.Name())
+	t.Run("unset", func(t *testing.T) {
+		SetEnvironment("")
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		SetEnvironment("dev")
 		assert.True(t, f.Enabled(ctx))
 	})
 
-	t.Run("wrong casing", func(t *testing.T) {
-		f := NewFeature(t.Name())
-		ctx := WithOverrideString(ctx, "Foo", "Foo1,Foo"+strings.ToUpper(t.Name()))
+	t.Run("allowed wrong casing", func(t *testing.T) {
+		SetEnvironment("staging")
 		assert.True(t, f.Enabled(ctx))
 	})
 
-	t.Run("negative", func(t *testing.T) {
-		f := NewFeature(t.Name())
-		ctx := WithOverrideString(ctx, "Foo", "Foo1,FooAlso")
+	t.Run("disallowed", func(t *testing.T) {
+		SetEnvironment("prod")
 		assert.False(t, f.Enabled(ctx))
 	})
 }
 
-func TestFeatureDuplicateName(t *testing.T) {
-	NewFeature("FeatureName")
-	assert.Panics(t, func() {
-		NewFeature("featureName")
+var benchmarkWithValueContext context.Context
+
+// WithValue is called on every request, so it shouldn't cost more than context.WithValue
+func TestWithValueAllocations(t *testing.T) {
+	ctx := context.Background()
+	allocs := testing.AllocsPerRun(100, func() {
+		benchmarkWithValueContext = WithValue(ctx, Key("test-key"), "test-value")
 	})
+	assert.LessOrEqual(t, allocs, float64(2))
 }
 
-func TestFeatureObserver(t *testing.T) {
+func BenchmarkWithValue(b *testing.B) {
 	ctx := context.Background()
-	f := NewFeature(t.Name())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchmarkWithValueContext = WithValue(ctx, Key("test-key"), "test-value")
+	}
+}
 
-	t.Run("enabled", func(t *testing.T) {
-		ctx := WithOverride(ctx, f, true)
-		called := false
-		ctx = WithObserver(ctx, func(ctx context.Context, feat string, state bool) {
-			called = true
-			assert.Equal(t, f.name, feat)
-			assert.True(t, state)
-		})
-		f.Enabled(ctx)
-		assert.True(t, called)
+func TestMergeValues(t *testing.T) {
+	ctx := context.Background()
+	key, key2, key3 := Key("test-key"), Key("test-key-2"), Key("test-key-3")
+
+	t.Run("disjoint", func(t *testing.T) {
+		dst := WithValue(ctx, key, "dst")
+		src := WithValues(ctx, map[Key]string{key2: "src-2", key3: "src-3"})
+		merged := MergeValues(dst, src)
+		assert.Equal(t, "dst", getValue(merged, key))
+		assert.Equal(t, "src-2", getValue(merged, key2))
+		assert.Equal(t, "src-3", getValue(merged, key3))
 	})
 
-	t.Run("disabled", func(t *testing.T) {
-		called := false
-		ctx := WithObserver(ctx, func(ctx context.Context, feat string, state bool) {
-			called = true
-			assert.Equal(t, f.name, feat)
-			assert.False(t, state)
+	t.Run("overlapping", func(t *testing.T) {
+		dst := WithValue(ctx, key, "dst")
+		src := WithValues(ctx, map[Key]string{"TEST-KEY": "src", key2: "src-2"})
+		merged := MergeValues(dst, src)
+		assert.Equal(t, "dst", getValue(merged, key))
+		assert.Equal(t, "src-2", getValue(merged, key2))
+	})
+
+	t.Run("shadowed source values", func(t *testing.T) {
+		src := WithValue(ctx, key, "old")
+		src, cancel := context.WithCancel(src)
+		defer cancel()
+		src = WithValue(src, key, "new")
+		merged := MergeValues(ctx, src)
+		assert.Equal(t, "new", getValue(merged, key))
+	})
+
+	t.Run("nothing to merge", func(t *testing.T) {
+		dst := WithValue(ctx, key, "dst")
+		assert.Equal(t, dst, MergeValues(dst, ctx))
+		assert.Equal(t, dst, MergeValues(dst, WithValue(ctx, key, "src")))
+	})
+
+	t.Run("matchers", func(t *testing.T) {
+		f := NewFeature(t.Name(), WithAND(WithExactMatch(key, "value"), WithExactMatch(key2, "value-2")))
+		merged := MergeValues(WithValue(ctx, key, "value"), WithValue(ctx, key2, "value-2"))
+		assert.True(t, f.Enabled(merged))
+	})
+}
+
+func TestCapture(t *testing.T) {
+	region, tenant, missing := Key("region"), Key("tenant"), Key("missing")
+	f := NewFeature(t.Name(), WithExactMatch(region, "westus"), WithPercentage(tenant, 50), WithKeyPresent(missing))
+	keys := f.Keys()
+
+	for i := 0; i < 100; i++ {
+		ctx := WithValues(context.Background(), map[Key]string{region: "eastus", tenant: strconv.Itoa(i)})
+		ctx = WithValueNormalizer(ctx, strings.ToLower)
+		captured := Capture(ctx, keys...)
+		assert.NotContains(t, captured, missing)
+
+		replayed := WithCaptured(context.Background(), captured)
+		assert.Equal(t, f.Enabled(ctx), f.Enabled(replayed), "tenant %d", i)
+	}
+
+	t.Run("normalized", func(t *testing.T) {
+		ctx := WithValueNormalizer(WithValue(context.Background(), region, "WestUS"), strings.ToLower)
+		captured := Capture(ctx, region)
+		assert.Equal(t, map[Key]string{region: "westus"}, captured)
+		assert.True(t, f.Enabled(WithCaptured(context.Background(), captured)))
+	})
+}
+
+func TestWithValueMeta(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	f := NewFeature(t.Name(), WithExactMatch(key, "westus"))
+	meta := map[string]string{"source": "header X-Region", "ts": "2021-06-01T00:00:00Z"}
+	ctx = WithValueMeta(ctx, key, "westus", meta)
+
+	t.Run("round trip", func(t *testing.T) {
+		assert.Equal(t, meta, ValueMeta(ctx, Key("TEST-KEY")))
+	})
+
+	t.Run("matching unaffected", func(t *testing.T) {
+		assert.True(t, f.Enabled(ctx))
+		assert.False(t, f.Enabled(WithValueMeta(ctx, key, "eastus", meta)))
+	})
+
+	t.Run("no metadata", func(t *testing.T) {
+		assert.Nil(t, ValueMeta(WithValue(context.Background(), key, "westus"), key))
+	})
+
+	t.Run("replaced value", func(t *testing.T) {
+		assert.Nil(t, ValueMeta(WithValue(ctx, key, "eastus"), key))
+	})
+
+	t.Run("observer", func(t *testing.T) {
+		var observed map[string]string
+		ctx := WithObserver(ctx, func(ctx context.Context, feature string, state bool) {
+			observed = ValueMeta(ctx, key)
 		})
-		f.Enabled(ctx)
-		assert.True(t, called)
+		assert.True(t, f.Enabled(ctx))
+		assert.Equal(t, meta, observed)
+	})
+}
+
+func TestFeatureHostname(t *testing.T) {
+	ctx := context.Background()
+	f := NewFeature(t.Name(), WithHostname("canary-0", "Canary-1"))
+	original := getHostname()
+	defer SetHostname(original)
+
+	t.Run("matching", func(t *testing.T) {
+		SetHostname("canary-0")
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("matching wrong casing", func(t *testing.T) {
+		SetHostname("CANARY-1")
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("not matching", func(t *testing.T) {
+		SetHostname("web-7")
+		assert.False(t, f.Enabled(ctx))
+	})
+}
+
+func TestWithValues(t *testing.T) {
+	ctx := context.Background()
+	key, key2, key3 := Key("test-key"), Key("test-key-2"), Key("test-key-3")
+
+	t.Run("sets all values", func(t *testing.T) {
+		ctx := WithValues(ctx, map[Key]string{key: "value", key2: "value-2"})
+		assert.Equal(t, "value", getValue(ctx, key))
+		assert.Equal(t, "value-2", getValue(ctx, key2))
+		assert.Equal(t, "", getValue(ctx, key3))
+	})
+
+	t.Run("wrong casing", func(t *testing.T) {
+		ctx := WithValues(ctx, map[Key]string{"TEST-KEY": "value"})
+		assert.Equal(t, "value", getValue(ctx, key))
+	})
+
+	t.Run("WithValues after WithValue", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "old")
+		ctx = WithValue(ctx, key3, "untouched")
+		ctx = WithValues(ctx, map[Key]string{key: "new", key2: "value-2"})
+		assert.Equal(t, "new", getValue(ctx, key))
+		assert.Equal(t, "value-2", getValue(ctx, key2))
+		assert.Equal(t, "untouched", getValue(ctx, key3))
+	})
+
+	t.Run("WithValue after WithValues", func(t *testing.T) {
+		ctx := WithValues(ctx, map[Key]string{key: "old", key2: "value-2"})
+		ctx = WithValue(ctx, key, "new")
+		assert.Equal(t, "new", getValue(ctx, key))
+		assert.Equal(t, "value-2", getValue(ctx, key2))
+	})
+
+	t.Run("matchers", func(t *testing.T) {
+		f := NewFeature(t.Name(), WithAND(WithExactMatch(key, "value"), WithExactMatch(key2, "value-2")))
+		ctx := WithValues(ctx, map[Key]string{key: "value", key2: "value-2"})
+		assert.True(t, f.Enabled(ctx))
+	})
+}
+
+func TestFeaturePercentage(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	f := NewFeature(t.Name(), WithPercentage(key, 50))
+
+	t.Run("positive", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "1")
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("wrong casing", func(t *testing.T) {
+		ctx := WithValue(ctx, Key("TEST-KEY"), "1")
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "3")
+		assert.False(t, f.Enabled(ctx))
+	})
+}
+
+func TestHash(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		value := strconv.Itoa(i)
+		h := fnv.New32a()
+		h.Write([]byte(value))
+		assert.Equal(t, h.Sum32(), hash("", value), "value %s", value)
+	}
+	h := fnv.New32a()
+	assert.Equal(t, h.Sum32(), hash("", ""))
+}
+
+func TestHashPrefixed(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		value := strconv.Itoa(i)
+		assert.Equal(t, hash("westus", value), hashPrefixed("", "westus", value), "value %s", value)
+		assert.NotEqual(t, hashPrefixed("a", "bc", value), hashPrefixed("ab", "c", value), "value %s", value)
+		assert.NotEqual(t, hash("", value), hashPrefixed("", "", value), "value %s", value)
+		assert.NotEqual(t, hash("salt", value), hashPrefixed("salt", "", value), "value %s", value)
+	}
+}
+
+var (
+	benchmarkPercentageFeature = NewFeature("BenchmarkPercentage", WithPercentage(Key("test-key"), 50))
+
+	// Equivalent to benchmarkPercentageFeature using the previous implementation, which allocated an fnv hasher
+	benchmarkPercentageStdlibFeature = NewFeature("BenchmarkPercentageStdlib", func(f *Feature) *matcher {
+		return &matcher{fn: func(ctx context.Context) bool {
+			h := fnv.New32a()
+			h.Write([]byte(getValue(ctx, Key("test-key"))))
+			return h.Sum32()%100 < 50
+		}}
+	})
+)
+
+// newBenchmarkPercentageContexts returns contexts with distinct values so the hash isn't computed over a constant.
+func newBenchmarkPercentageContexts() []context.Context {
+	ctxs := make([]context.Context, 1000)
+	for i := range ctxs {
+		ctxs[i] = WithValue(context.Background(), Key("test-key"), "test-value-"+strconv.Itoa(i))
+	}
+	return ctxs
+}
+
+func BenchmarkPercentage(b *testing.B) {
+	f, ctxs := benchmarkPercentageFeature, newBenchmarkPercentageContexts()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.Enabled(ctxs[i%len(ctxs)])
+	}
+}
+
+func BenchmarkPercentageStdlib(b *testing.B) {
+	f, ctxs := benchmarkPercentageStdlibFeature, newBenchmarkPercentageContexts()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.Enabled(ctxs[i%len(ctxs)])
+	}
+}
+
+func TestBucketOf(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	features := map[uint32]*Feature{}
+	for _, percent := range []uint32{10, 50, 90} {
+		features[percent] = NewFeature(t.Name()+strconv.Itoa(int(percent)), WithPercentage(key, percent))
+	}
+
+	for i := 0; i < 100; i++ {
+		value := strconv.Itoa(i)
+		for percent, f := range features {
+			ctx := WithValue(ctx, key, value)
+			assert.Equal(t, BucketOf(value) < percent, f.Enabled(ctx), "value %s at %d%%", value, percent)
+
+			salted := WithSalt(ctx, "tenant-a")
+			assert.Equal(t, BucketOfSalted("tenant-a", value) < percent, f.Enabled(salted), "salted value %s at %d%%", value, percent)
+		}
+	}
+}
+
+func TestFeaturePercentageValidation(t *testing.T) {
+	key := Key("test-key")
+
+	t.Run("zero", func(t *testing.T) {
+		f := NewFeature(t.Name(), WithPercentage(key, 0))
+		for i := 0; i < 100; i++ {
+			assert.False(t, f.Enabled(WithValue(context.Background(), key, strconv.Itoa(i))))
+		}
+	})
+
+	t.Run("hundred", func(t *testing.T) {
+		f := NewFeature(t.Name(), WithPercentage(key, 100))
+		for i := 0; i < 100; i++ {
+			assert.True(t, f.Enabled(WithValue(context.Background(), key, strconv.Itoa(i))))
+		}
+	})
+
+	t.Run("out of range", func(t *testing.T) {
+		assert.Panics(t, func() { WithPercentage(key, 150) })
+		assert.Panics(t, func() { WithPercentageComplement(key, 150) })
+		assert.Panics(t, func() { WithPercentageList(key, 150, nil, nil) })
+		assert.Panics(t, func() { WithPercentageHashFunc(key, 150, nil) })
+	})
+}
+
+func TestFeaturePercentageSalt(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	f := NewFeature(t.Name(), WithPercentage(key, 50))
+
+	tenantA := WithSalt(ctx, "tenant-a")
+	tenantB := WithSalt(ctx, "tenant-b")
+
+	differences := 0
+	for i := 0; i < 100; i++ {
+		value := strconv.Itoa(i)
+		a := f.Enabled(WithValue(tenantA, key, value))
+		b := f.Enabled(WithValue(tenantB, key, value))
+		assert.Equal(t, a, f.Enabled(WithValue(tenantA, key, value)), "salted buckets are stable")
+		if a != b {
+			differences++
+		}
+	}
+	assert.NotZero(t, differences)
+
+	t.Run("empty salt", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			ctx := WithValue(ctx, key, strconv.Itoa(i))
+			assert.Equal(t, f.Enabled(ctx), f.Enabled(WithSalt(ctx, "")))
+		}
+	})
+}
+
+func TestFeaturePercentageStable(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	f := NewFeature(t.Name(), WithPercentageStable(key, 50))
+
+	for i := 0; i < 100; i++ {
+		value := "id" + strconv.Itoa(i)
+		expected := f.Enabled(WithValue(ctx, key, value))
+		assert.Equal(t, bucket(ctx, value) < 50, expected)
+		for _, variant := range []string{" " + value + " ", strings.ToUpper(value), "\t" + strings.ToUpper(value)} {
+			assert.Equal(t, expected, f.Enabled(WithValue(ctx, key, variant)), "value %q", variant)
+		}
+	}
+
+	t.Run("whitespace", func(t *testing.T) {
+		assert.Equal(t, f.Enabled(WithValue(ctx, key, "123")), f.Enabled(WithValue(ctx, key, " 123 ")))
+	})
+}
+
+func TestFeaturePercentageBytes(t *testing.T) {
+	ctx := context.Background()
+	key := Key("trace-id")
+	f := NewFeature(t.Name(), WithPercentageBytes(key, 50))
+
+	t.Run("sticky", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			id := []byte{byte(i), 0xff, 0x00, byte(i * 7)}
+			expected := f.Enabled(WithBytesValue(ctx, key, id))
+			assert.Equal(t, expected, f.Enabled(WithBytesValue(ctx, key, append([]byte{}, id...))))
+		}
+	})
+
+	t.Run("matches string hashing", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			value := strconv.Itoa(i)
+			ctx := WithBytesValue(ctx, key, []byte(value))
+			assert.Equal(t, bucket(ctx, value) < 50, f.Enabled(ctx))
+		}
+	})
+
+	t.Run("separate from string values", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "1")
+		assert.Nil(t, getBytesValue(ctx, key))
+		ctx = WithBytesValue(ctx, key, []byte{1})
+		assert.Equal(t, "1", getValue(ctx, key))
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		_, err := f.EnabledStrict(ctx)
+		assert.True(t, errors.Is(err, ErrMissingKey))
+		_, err = f.EnabledStrict(WithBytesValue(ctx, key, []byte{1}))
+		assert.NoError(t, err)
+	})
+}
+
+func TestFeaturePercentageHashFunc(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	identity := func(b []byte) uint64 {
+		n, _ := strconv.ParseUint(string(b), 10, 64)
+		return n
+	}
+	f := NewFeature(t.Name(), WithPercentageHashFunc(key, 30, identity))
+
+	for value, expected := range map[string]bool{
+		"0":   true,
+		"29":  true,
+		"30":  false,
+		"99":  false,
+		"100": true,
+		"129": true,
+		"130": false,
+	} {
+		ctx := WithValue(ctx, key, value)
+		assert.Equal(t, expected, f.Enabled(ctx), "value %s", value)
+	}
+}
+
+type memoryAssignmentStore struct {
+	assignments map[string]bool
+	err         error
+}
+
+func (m *memoryAssignmentStore) GetAssignment(ctx context.Context, feature, value string) (bool, bool, error) {
+	if m.err != nil {
+		return false, false, m.err
+	}
+	enabled, ok := m.assignments[feature+"/"+value]
+	return enabled, ok, nil
+}
+
+func (m *memoryAssignmentStore) SetAssignment(ctx context.Context, feature, value string, enabled bool) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.assignments[feature+"/"+value] = enabled
+	return nil
+}
+
+func TestFeatureStickyPercentage(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	store := &memoryAssignmentStore{assignments: map[string]bool{}}
+	f := NewFeature(t.Name(), WithStickyPercentage(store, key, 100))
+
+	for i := 0; i < 10; i++ {
+		assert.True(t, f.Enabled(WithValue(ctx, key, strconv.Itoa(i))))
+	}
+	assert.Len(t, store.assignments, 10)
+
+	t.Run("percent lowered", func(t *testing.T) {
+		f.SetMatchers(WithStickyPercentage(store, key, 0))
+		for i := 0; i < 10; i++ {
+			assert.True(t, f.Enabled(WithValue(ctx, key, strconv.Itoa(i))))
+		}
+		assert.False(t, f.Enabled(WithValue(ctx, key, "new value")))
+		assert.Equal(t, false, store.assignments[f.name+"/new value"])
+	})
+
+	t.Run("store error", func(t *testing.T) {
+		store := &memoryAssignmentStore{err: errors.New("test error")}
+		f := NewFeature(t.Name(), WithStickyPercentage(store, key, 50))
+		assert.True(t, f.Enabled(WithValue(ctx, key, "1")))
+		assert.False(t, f.Enabled(WithValue(ctx, key, "3")))
+	})
+}
+
+func TestFeaturePercentageComplement(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	f := NewFeature(t.Name(), WithPercentage(key, 30))
+	complement := NewFeature(t.Name()+"Complement", WithPercentageComplement(key, 30))
+
+	for i := 0; i < 1000; i++ {
+		ctx := WithValue(ctx, key, strconv.Itoa(i))
+		assert.NotEqual(t, f.Enabled(ctx), complement.Enabled(ctx), "value %d", i)
+	}
+}
+
+func TestFeaturePercentageBoundaryWarn(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	f := NewFeature(t.Name(), WithPercentageBoundaryWarn(key, 50, 2))
+	warnings := func() float64 { return testutil.ToFloat64(boundaryMetric.WithLabelValues(f.name)) }
+
+	// Find a value in each bucket around the boundary
+	values := map[uint32]string{}
+	for i := 0; len(values) < 100; i++ {
+		if _, ok := values[BucketOf(strconv.Itoa(i))]; !ok {
+			values[BucketOf(strconv.Itoa(i))] = strconv.Itoa(i)
+		}
+	}
+
+	tests := []struct {
+		bucket  uint32
+		enabled bool
+		warned  bool
+	}{
+		{bucket: 47, enabled: true, warned: false},
+		{bucket: 48, enabled: true, warned: true},
+		{bucket: 49, enabled: true, warned: true},
+		{bucket: 50, enabled: false, warned: true},
+		{bucket: 51, enabled: false, warned: true},
+		{bucket: 52, enabled: false, warned: false},
+	}
+	for _, tc := range tests {
+		before := warnings()
+		assert.Equal(t, tc.enabled, f.Enabled(WithValue(ctx, key, values[tc.bucket])), "bucket %d", tc.bucket)
+		assert.Equal(t, tc.warned, warnings() > before, "bucket %d", tc.bucket)
+	}
+}
+
+func TestFeatureStratifiedPercentage(t *testing.T) {
+	ctx := context.Background()
+	region, user := Key("region"), Key("user")
+	f := NewFeature(t.Name(), WithStratifiedPercentage(region, user, 50))
+
+	cohorts := map[string]map[int]bool{}
+	for _, stratum := range []string{"westus", "eastus"} {
+		cohorts[stratum] = map[int]bool{}
+		for i := 0; i < 1000; i++ {
+			ctx := WithValues(ctx, map[Key]string{region: stratum, user: strconv.Itoa(i)})
+			cohorts[stratum][i] = f.Enabled(ctx)
+		}
+	}
+
+	for stratum, cohort := range cohorts {
+		enabled := 0
+		for _, ok := range cohort {
+			if ok {
+				enabled++
+			}
+		}
+		assert.InDelta(t, 500, enabled, 75, "stratum %s", stratum)
+	}
+
+	// The same units land in different cohorts in each stratum
+	same := 0
+	for i := 0; i < 1000; i++ {
+		if cohorts["westus"][i] == cohorts["eastus"][i] {
+			same++
+		}
+	}
+	assert.InDelta(t, 500, same, 100)
+}
+
+func TestFeatureDailyPercentage(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	f := NewFeature(t.Name(), WithDailyPercentage(key, 10))
+
+	clock := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	cohort := func() map[string]struct{} {
+		enabled := map[string]struct{}{}
+		for i := 0; i < 1000; i++ {
+			value := strconv.Itoa(i)
+			if f.Enabled(WithValue(ctx, key, value)) {
+				enabled[value] = struct{}{}
+			}
+		}
+		return enabled
+	}
+
+	first := cohort()
+	assert.InDelta(t, 100, len(first), 30)
+
+	t.Run("stable within a day", func(t *testing.T) {
+		clock = time.Date(2021, 6, 1, 23, 59, 59, 0, time.UTC)
+		assert.Equal(t, first, cohort())
+	})
+
+	t.Run("utc", func(t *testing.T) {
+		clock = time.Date(2021, 6, 1, 20, 0, 0, 0, time.FixedZone("UTC-5", -5*60*60))
+		assert.NotEqual(t, first, cohort())
+	})
+
+	t.Run("rotates at midnight", func(t *testing.T) {
+		clock = time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC)
+		second := cohort()
+		assert.InDelta(t, 100, len(second), 30)
+		overlap := 0
+		for value := range second {
+			if _, ok := first[value]; ok {
+				overlap++
+			}
+		}
+		assert.Less(t, overlap, len(second)/2)
+	})
+}
+
+func TestFeaturePercentageRange(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	f := NewFeature(t.Name(), WithPercentageRange(key, 30, 45))
+	other := NewFeature(t.Name()+"Other", WithPercentageRange(key, 45, 60))
+
+	t.Run("boundaries", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			value := strconv.Itoa(i)
+			ctx := WithValue(ctx, key, value)
+			b := bucket(ctx, value)
+			assert.Equal(t, b >= 30 && b < 45, f.Enabled(ctx), "value %s in bucket %d", value, b)
+		}
+	})
+
+	t.Run("disjoint", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			ctx := WithValue(ctx, key, strconv.Itoa(i))
+			assert.False(t, f.Enabled(ctx) && other.Enabled(ctx), "value %d", i)
+		}
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		assert.Panics(t, func() { WithPercentageRange(key, 45, 30) })
+		assert.Panics(t, func() { WithPercentageRange(key, 30, 30) })
+		assert.Panics(t, func() { WithPercentageRange(key, 30, 101) })
+		assert.NotPanics(t, func() { WithPercentageRange(key, 0, 100) })
+	})
+}
+
+func TestFeatureWeightedPercentage(t *testing.T) {
+	ctx := context.Background()
+	tenant, size := Key("tenant"), Key("size")
+	f := NewFeature(t.Name(), WithWeightedPercentage(tenant, size, 10))
+	const n = 10000
+
+	rate := func(weight string) float64 {
+		enabled := 0
+		for i := 0; i < n; i++ {
+			ctx := WithValue(ctx, tenant, "tenant-"+strconv.Itoa(i))
+			if weight != "" {
+				ctx = WithValue(ctx, size, weight)
+			}
+			if f.Enabled(ctx) {
+				enabled++
+			}
+		}
+		return float64(enabled) / n
+	}
+
+	t.Run("higher weights are enabled more often", func(t *testing.T) {
+		assert.InDelta(t, 0.05, rate("0.5"), 0.02)
+		assert.InDelta(t, 0.10, rate("1"), 0.02)
+		assert.InDelta(t, 0.65, rate("10"), 0.02)
+		assert.InDelta(t, 1.00, rate("100"), 0.01)
+	})
+
+	t.Run("missing or invalid weight", func(t *testing.T) {
+		assert.Equal(t, rate("1"), rate(""))
+		assert.Equal(t, rate("1"), rate("big"))
+	})
+
+	t.Run("non-positive weight", func(t *testing.T) {
+		assert.Equal(t, float64(0), rate("0"))
+		assert.Equal(t, float64(0), rate("-5"))
+	})
+
+	t.Run("cohorts grow with weight", func(t *testing.T) {
+		for i := 0; i < n; i++ {
+			ctx := WithValue(ctx, tenant, "tenant-"+strconv.Itoa(i))
+			if f.Enabled(WithValue(ctx, size, "1")) {
+				assert.True(t, f.Enabled(WithValue(ctx, size, "2")), "value %d", i)
+			}
+		}
+	})
+}
+
+func TestFeaturePercentageAtLeastOne(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+
+	// Find a small population that a plain 10% rollout misses entirely
+	var population []string
+	for i := 0; len(population) < 5; i++ {
+		value := "tenant-" + strconv.Itoa(i)
+		if bucket(ctx, value) >= 10 {
+			population = append(population, value)
+		}
+	}
+	f := NewFeature(t.Name(), WithPercentageAtLeastOne(key, 10, population))
+
+	t.Run("exactly one enabled", func(t *testing.T) {
+		enabled := 0
+		for _, value := range population {
+			if f.Enabled(WithValue(ctx, key, value)) {
+				enabled++
+			}
+		}
+		assert.Equal(t, 1, enabled)
+	})
+
+	t.Run("stable", func(t *testing.T) {
+		for _, value := range population {
+			ctx := WithValue(ctx, key, value)
+			assert.Equal(t, f.Enabled(ctx), f.Enabled(ctx))
+		}
+	})
+
+	t.Run("unknown values use the percentage", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			value := strconv.Itoa(i)
+			ctx := WithValue(ctx, key, value)
+			assert.Equal(t, bucket(ctx, value) < 10, f.Enabled(ctx), "value %s", value)
+		}
+	})
+
+	t.Run("no extra when a known value is already enabled", func(t *testing.T) {
+		var inCohort string
+		for i := 0; inCohort == ""; i++ {
+			if value := strconv.Itoa(i); bucket(ctx, value) < 10 {
+				inCohort = value
+			}
+		}
+		f := NewFeature(t.Name(), WithPercentageAtLeastOne(key, 10, append([]string{inCohort}, population...)))
+		for _, value := range population {
+			assert.False(t, f.Enabled(WithValue(ctx, key, value)), "value %s", value)
+		}
+		assert.True(t, f.Enabled(WithValue(ctx, key, inCohort)))
+	})
+
+	t.Run("salted", func(t *testing.T) {
+		ctx := WithSalt(ctx, "test-salt")
+		var population []string
+		for i := 0; len(population) < 5; i++ {
+			value := "tenant-" + strconv.Itoa(i)
+			if bucket(ctx, value) >= 10 {
+				population = append(population, value)
+			}
+		}
+		f := NewFeature(t.Name(), WithPercentageAtLeastOne(key, 10, population))
+
+		var enabled []string
+		for _, value := range population {
+			if f.Enabled(WithValue(ctx, key, value)) {
+				enabled = append(enabled, value)
+			}
+		}
+		if !assert.Len(t, enabled, 1) {
+			return
+		}
+
+		lowest := population[0]
+		for _, value := range population {
+			if BucketOfSalted("test-salt", value) < BucketOfSalted("test-salt", lowest) {
+				lowest = value
+			}
+		}
+		assert.Equal(t, lowest, enabled[0])
+	})
+
+	t.Run("zero percent", func(t *testing.T) {
+		f := NewFeature(t.Name(), WithPercentageAtLeastOne(key, 0, population))
+		for _, value := range population {
+			assert.False(t, f.Enabled(WithValue(ctx, key, value)), "value %s", value)
+		}
+	})
+}
+
+func TestFeaturePercentageList(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	// "1" is in the 50% cohort, "3" is not
+	f := NewFeature(t.Name(), WithPercentageList(key, 50, []string{"3", "VIP", "both"}, []string{"1", "Bad", "both"}))
+
+	t.Run("never", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "1")
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("never wrong casing", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "bAD")
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("always", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "3")
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("always wrong casing", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "vip")
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("never beats always", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "both")
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("percentage", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			value := strconv.Itoa(i + 100)
+			ctx := WithValue(ctx, key, value)
+			assert.Equal(t, bucket(ctx, value) < 50, f.Enabled(ctx), "value %s", value)
+		}
+	})
+}
+
+func TestFeatureLeveledPercentage(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	f := NewFeature(t.Name(), WithLeveledPercentage(key, map[int64]uint32{10: 0, 20: 50, 30: 100}))
+
+	enabled := func(ctx context.Context) int {
+		n := 0
+		for i := 0; i < 1000; i++ {
+			if f.Enabled(WithValue(ctx, key, strconv.Itoa(i))) {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("no level", func(t *testing.T) {
+		assert.Equal(t, 0, enabled(ctx))
+	})
+
+	t.Run("below lowest level", func(t *testing.T) {
+		assert.Equal(t, 0, enabled(WithReleaseLevel(ctx, 5)))
+	})
+
+	t.Run("progression", func(t *testing.T) {
+		assert.Equal(t, 0, enabled(WithReleaseLevel(ctx, 10)))
+		assert.InDelta(t, 500, enabled(WithReleaseLevel(ctx, 20)), 50)
+		assert.InDelta(t, 500, enabled(WithReleaseLevel(ctx, 25)), 50)
+		assert.Equal(t, 1000, enabled(WithReleaseLevel(ctx, 30)))
+		assert.Equal(t, 1000, enabled(WithReleaseLevel(ctx, 1000)))
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			ctx := WithValue(ctx, key, strconv.Itoa(i))
+			assert.True(t, f.Enabled(WithReleaseLevel(ctx, 30)), "value %d", i)
+			assert.Equal(t, bucket(ctx, strconv.Itoa(i)) < 50, f.Enabled(WithReleaseLevel(ctx, 20)), "value %d", i)
+		}
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		assert.Panics(t, func() { WithLeveledPercentage(key, map[int64]uint32{1: 101}) })
+	})
+}
+
+func TestFeaturePercentageNormalized(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+
+	// Deny 200 of 1000 values, all of which would otherwise be in the 50% cohort
+	var population, denied []string
+	for i := 0; i < 1000; i++ {
+		value := strconv.Itoa(i)
+		population = append(population, value)
+		if len(denied) < 200 && bucket(ctx, value) < 50 {
+			denied = append(denied, value)
+		}
+	}
+	normalized := NewFeature(t.Name(), WithPercentageNormalized(key, 50, denied, len(population)))
+	plain := NewFeature(t.Name()+"Plain", WithPercentageList(key, 50, nil, denied))
+
+	eligibleRate := func(f *Feature) float64 {
+		enabled, eligible := 0, 0
+		deniedSet := newFoldedSet(denied)
+		for _, value := range population {
+			if _, ok := deniedSet[value]; ok {
+				assert.False(t, f.Enabled(WithValue(ctx, key, value)), "denied value %s", value)
+				continue
+			}
+			eligible++
+			if f.Enabled(WithValue(ctx, key, value)) {
+				enabled++
+			}
+		}
+		return float64(enabled) / float64(eligible)
+	}
+
+	t.Run("without normalization", func(t *testing.T) {
+		assert.InDelta(t, 0.375, eligibleRate(plain), 0.05)
+	})
+
+	t.Run("with normalization", func(t *testing.T) {
+		assert.InDelta(t, 0.5, eligibleRate(normalized), 0.05)
+	})
+
+	t.Run("salted", func(t *testing.T) {
+		ctx := WithSalt(ctx, "tenant-a")
+		assert.False(t, normalized.Enabled(WithValue(ctx, key, denied[0])))
+	})
+
+	t.Run("many salts", func(t *testing.T) {
+		f := NewFeature(t.Name(), WithPercentageNormalized(key, 50, denied, len(population)))
+		for i := 0; i < maxNormalizedSalts*2; i++ {
+			ctx := WithValue(WithSalt(ctx, strconv.Itoa(i)), key, population[i%len(population)])
+			expected := NewFeature(t.Name()+strconv.Itoa(i), WithPercentageNormalized(key, 50, denied, len(population)))
+			assert.Equal(t, expected.Enabled(ctx), f.Enabled(ctx), "salt %d", i)
+			assert.Equal(t, expected.Enabled(ctx), f.Enabled(ctx), "salt %d (cached)", i)
+		}
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		assert.Panics(t, func() { WithPercentageNormalized(key, 101, nil, 10) })
+		assert.Panics(t, func() { WithPercentageNormalized(key, 50, []string{"a", "b"}, 1) })
+	})
+}
+
+func TestFeaturePreview(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	f := NewFeature(t.Name(), WithPercentage(key, 50))
+
+	assert.Equal(t, map[string]bool{"1": true, "3": false}, f.Preview(ctx, key, []string{"1", "3"}))
+
+	t.Run("matches Enabled", func(t *testing.T) {
+		values := make([]string, 100)
+		for i := range values {
+			values[i] = strconv.Itoa(i)
+		}
+		preview := f.Preview(ctx, key, values)
+		assert.Len(t, preview, len(values))
+		for _, value := range values {
+			assert.Equal(t, f.Enabled(WithValue(ctx, key, value)), preview[value], "value %s", value)
+		}
+	})
+
+	t.Run("evaluation cache", func(t *testing.T) {
+		ctx := WithEvaluationCache(ctx)
+		assert.Equal(t, map[string]bool{"1": true, "3": false}, f.Preview(ctx, key, []string{"1", "3"}))
+		assert.Equal(t, map[string]bool{"3": false, "1": true}, f.Preview(ctx, key, []string{"3", "1"}))
+	})
+
+	t.Run("no side effects", func(t *testing.T) {
+		var observed int
+		ctx := WithObserver(ctx, func(ctx context.Context, feature string, state bool) { observed++ })
+		f := NewFeature(t.Name(), WithPercentage(key, 50))
+		f.Preview(ctx, key, []string{"1", "3"})
+		assert.Equal(t, 0, observed)
+		assert.Equal(t, float64(0), testutil.ToFloat64(enabledMetric.WithLabelValues(f.name, string(ReasonMatcher))))
+	})
+}
+
+func TestFeatureMatchOR(t *testing.T) {
+	ctx := context.Background()
+	key, value, value2 := Key("test-key"), "test-value", "test-value-2"
+	f := NewFeature(t.Name(), WithExactMatch(key, value), WithExactMatch(key, value2))
+
+	t.Run("first", func(t *testing.T) {
+		ctx := WithValue(ctx, key, value)
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("second", func(t *testing.T) {
+		ctx := WithValue(ctx, key, value2)
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("both", func(t *testing.T) {
+		ctx := WithValue(ctx, key, value)
+		ctx = WithValue(ctx, key, value2)
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("neither", func(t *testing.T) {
+		assert.False(t, f.Enabled(ctx))
+	})
+}
+
+func TestFeatureMatchAND(t *testing.T) {
+	ctx := context.Background()
+	key, key2, value, value2 := Key("test-key"), Key("test-key-2"), "test-value", "test-value-2"
+	f := NewFeature(t.Name(), WithAND(WithExactMatch(key, value), WithExactMatch(key2, value2)))
+
+	t.Run("first", func(t *testing.T) {
+		ctx := WithValue(ctx, key, value)
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("second", func(t *testing.T) {
+		ctx := WithValue(ctx, key2, value2)
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("both", func(t *testing.T) {
+		ctx := WithValue(ctx, key, value)
+		ctx = WithValue(ctx, key2, value2)
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("neither", func(t *testing.T) {
+		assert.False(t, f.Enabled(ctx))
+	})
+}
+
+func TestFeatureMatchXOR(t *testing.T) {
+	ctx := context.Background()
+	key, key2, key3 := Key("test-key"), Key("test-key-2"), Key("test-key-3")
+	f := NewFeature(t.Name(), WithXOR(
+		WithExactMatch(key, "value"),
+		WithExactMatch(key2, "value"),
+		WithExactMatch(key3, "value")))
+
+	t.Run("zero", func(t *testing.T) {
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("one", func(t *testing.T) {
+		ctx := WithValue(ctx, key2, "value")
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("two", func(t *testing.T) {
+		ctx := WithValues(ctx, map[Key]string{key: "value", key3: "value"})
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("three", func(t *testing.T) {
+		ctx := WithValues(ctx, map[Key]string{key: "value", key2: "value", key3: "value"})
+		assert.False(t, f.Enabled(ctx))
+	})
+}
+
+func TestFeatureKeys(t *testing.T) {
+	key, key2, key3 := Key("test-key"), Key("test-key-2"), Key("test-key-3")
+
+	t.Run("no matchers", func(t *testing.T) {
+		f := NewFeature(t.Name())
+		assert.Empty(t, f.Keys())
+	})
+
+	t.Run("AND", func(t *testing.T) {
+		f := NewFeature(t.Name(), WithAND(WithExactMatch(key, "value"), WithPercentage(key2, 50)))
+		assert.Equal(t, []Key{key, key2}, f.Keys())
+	})
+
+	t.Run("dedup", func(t *testing.T) {
+		f := NewFeature(t.Name(),
+			WithAND(WithExactMatch(key, "value"), WithPercentage(key2, 50)),
+			WithExactMatch(Key("TEST-KEY"), "value-2"),
+			WithExactMatchAny("value", key2, key3))
+		assert.Equal(t, []Key{key, key2, key3}, f.Keys())
+	})
+}
+
+func TestFeatureMatchNilChildren(t *testing.T) {
+	ctx := context.Background()
+	key, value := Key("test-key"), "test-value"
+	match := WithExactMatch(key, value)
+	none := MatcherOption(func(f *Feature) *matcher { return nil })
+
+	tests := map[string]MatcherOption{
+		"and":        WithAND(none, match, none),
+		"or":         WithOR(none, match, none),
+		"not":        WithNOT(WithNOT(WithAND(none, match))),
+		"at least n": WithAtLeastN(1, none, match),
+		"xor":        WithXOR(none, match, none),
+	}
+	for name, opt := range tests {
+		opt := opt
+		t.Run(name, func(t *testing.T) {
+			f := NewFeature(t.Name(), opt)
+			for _, m := range f.getMatchers() {
+				assert.NotContains(t, m.matchers, (*matcher)(nil))
+			}
+
+			d := &Decision{}
+			assert.True(t, f.Enabled(WithDecisionSink(WithValue(ctx, key, value), d)))
+			assert.Equal(t, ReasonMatcher, d.Reason)
+			assert.False(t, f.Enabled(WithDecisionSink(ctx, d)))
+			assert.Equal(t, ReasonDefault, d.Reason)
+		})
+	}
+}
+
+func TestFeatureMatchAtLeastN(t *testing.T) {
+	ctx := context.Background()
+	key, key2, key3 := Key("test-key"), Key("test-key-2"), Key("test-key-3")
+	f := NewFeature(t.Name(), WithAtLeastN(2,
+		WithExactMatch(key, "value"),
+		WithExactMatch(key2, "value"),
+		WithExactMatch(key3, "value")))
+
+	t.Run("none", func(t *testing.T) {
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("n-1", func(t *testing.T) {
+		ctx := WithValue(ctx, key2, "value")
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("exactly n", func(t *testing.T) {
+		ctx := WithValues(ctx, map[Key]string{key: "value", key3: "value"})
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("all", func(t *testing.T) {
+		ctx := WithValues(ctx, map[Key]string{key: "value", key2: "value", key3: "value"})
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("invalid n", func(t *testing.T) {
+		assert.Panics(t, func() { WithAtLeastN(0, WithExactMatch(key, "value")) })
+		assert.Panics(t, func() { WithAtLeastN(2, WithExactMatch(key, "value")) })
+		assert.PanicsWithError(t, "coalmine WithAtLeastN requires 0 < n <= 1 matchers, got 2", func() {
+			NewFeature(t.Name(), WithAtLeastN(2, WithAlias(t.Name()+"Alias"), WithExactMatch(key, "value")))
+		})
+		assert.Nil(t, lookupFeature(t.Name()))
+	})
+}
+
+func TestFeatureOverride(t *testing.T) {
+	ctx := context.Background()
+	key, value := Key("test-key"), "test-value"
+	f := NewFeature(t.Name(), WithExactMatch(key, value))
+
+	t.Run("feature on, override off", func(t *testing.T) {
+		ctx := WithValue(ctx, key, value)
+		ctx = WithOverride(ctx, f, false)
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("feature on, override on", func(t *testing.T) {
+		ctx := WithValue(ctx, key, value)
+		ctx = WithOverride(ctx, f, true)
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("feature off, override off", func(t *testing.T) {
+		ctx := WithOverride(ctx, f, false)
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("feature off, override on", func(t *testing.T) {
+		ctx := WithOverride(ctx, f, true)
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("prove other feature not matched", func(t *testing.T) {
+		ctx := WithOverride(ctx, f, true)
+
+		f2 := NewFeature("some other feature")
+		assert.False(t, f2.Enabled(ctx))
+	})
+}
+
+func TestFeatureGlobalOverride(t *testing.T) {
+	key, value := Key("test-key"), "test-value"
+	f := NewFeature(t.Name(), WithExactMatch(key, value))
+
+	t.Run("enable across goroutines", func(t *testing.T) {
+		SetGlobalOverride(f, true)
+		defer ClearGlobalOverride(f)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.True(t, f.Enabled(context.Background()))
+		}()
+		wg.Wait()
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		SetGlobalOverride(f, false)
+		defer ClearGlobalOverride(f)
+		assert.False(t, f.Enabled(WithValue(context.Background(), key, value)))
+	})
+
+	t.Run("context override wins", func(t *testing.T) {
+		SetGlobalOverride(f, true)
+		defer ClearGlobalOverride(f)
+		assert.False(t, f.Enabled(WithOverride(context.Background(), f, false)))
+	})
+
+	t.Run("cleared", func(t *testing.T) {
+		SetGlobalOverride(f, true)
+		ClearGlobalOverride(f)
+		assert.False(t, f.Enabled(context.Background()))
+	})
+
+	t.Run("other features unaffected", func(t *testing.T) {
+		SetGlobalOverride(f, true)
+		defer ClearGlobalOverride(f)
+		f2 := NewFeature(t.Name())
+		assert.False(t, f2.Enabled(context.Background()))
+	})
+}
+
+func TestFeatureForce(t *testing.T) {
+	key, value := Key("test-key"), "test-value"
+	f := NewFeature(t.Name(), WithExactMatch(key, value))
+	defer f.ClearForce()
+
+	t.Run("force enable", func(t *testing.T) {
+		f.ForceEnable()
+		assert.True(t, f.Enabled(context.Background()))
+	})
+
+	t.Run("force disable", func(t *testing.T) {
+		f.ForceDisable()
+		assert.False(t, f.Enabled(WithValue(context.Background(), key, value)))
+	})
+
+	t.Run("context override takes precedence", func(t *testing.T) {
+		f.ForceDisable()
+		assert.True(t, f.Enabled(WithOverride(context.Background(), f, true)))
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		f.ForceEnable()
+		f.ClearForce()
+		assert.False(t, f.Enabled(context.Background()))
+		assert.True(t, f.Enabled(WithValue(context.Background(), key, value)))
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	key, value := Key("test-key"), "test-value"
+	features := []*Feature{
+		NewFeature(t.Name()+"Matcher", WithExactMatch(key, value)),
+		NewFeature(t.Name()+"Default", WithDefaultEnabled()),
+		NewFeature(t.Name() + "Global"),
+	}
+	SetGlobalOverride(features[2], true)
+	defer ClearGlobalOverride(features[2])
+	ctx = WithValue(ctx, key, value)
+	defer SetCircuitBreaker(false)
+
+	t.Run("closed", func(t *testing.T) {
+		for _, f := range features {
+			assert.True(t, f.Enabled(ctx), f.name)
+		}
+	})
+
+	t.Run("open", func(t *testing.T) {
+		SetCircuitBreaker(true)
+		assert.Equal(t, float64(1), testutil.ToFloat64(circuitBreakerMetric))
+		for _, f := range features {
+			d := &Decision{}
+			assert.False(t, f.Enabled(WithDecisionSink(ctx, d)), f.name)
+			assert.Equal(t, ReasonCircuitBreaker, d.Reason)
+			assert.False(t, f.Enabled(WithOverride(ctx, f, true)), f.name)
+		}
+	})
+
+	t.Run("overrides allowed", func(t *testing.T) {
+		SetCircuitBreaker(true)
+		SetCircuitBreakerOverrides(true)
+		defer SetCircuitBreakerOverrides(false)
+		for _, f := range features {
+			assert.True(t, f.Enabled(WithOverride(ctx, f, true)), f.name)
+			assert.False(t, f.Enabled(ctx), f.name)
+		}
+	})
+
+	t.Run("recovered", func(t *testing.T) {
+		SetCircuitBreaker(false)
+		assert.Equal(t, float64(0), testutil.ToFloat64(circuitBreakerMetric))
+		for _, f := range features {
+			assert.True(t, f.Enabled(ctx), f.name)
+		}
+	})
+}
+
+func TestFeatureOverridePrefix(t *testing.T) {
+	ctx := context.Background()
+	key, value := Key("test-key"), "test-value"
+	checkout := NewFeature(t.Name()+"Payments.Checkout", WithExactMatch(key, value))
+	refunds := NewFeature(t.Name()+"payments.refunds", WithDefaultEnabled())
+	search := NewFeature(t.Name() + "search.ranking")
+	name := t.Name()
+	prefix := name + "payments."
+
+	t.Run("enable", func(t *testing.T) {
+		ctx := WithOverridePrefix(ctx, prefix, true)
+		assert.True(t, checkout.Enabled(ctx))
+		assert.True(t, refunds.Enabled(ctx))
+		assert.False(t, search.Enabled(ctx))
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		ctx := WithOverridePrefix(WithValue(ctx, key, value), strings.ToUpper(prefix), false)
+		d := &Decision{}
+		assert.False(t, checkout.Enabled(WithDecisionSink(ctx, d)))
+		assert.Equal(t, ReasonOverride, d.Reason)
+		assert.False(t, refunds.Enabled(ctx))
+	})
+
+	t.Run("exact override wins", func(t *testing.T) {
+		ctx := WithOverride(ctx, refunds, false)
+		ctx = WithOverridePrefix(ctx, prefix, true)
+		assert.True(t, checkout.Enabled(ctx))
+		assert.False(t, refunds.Enabled(ctx))
+	})
+
+	t.Run("latest prefix wins", func(t *testing.T) {
+		ctx := WithOverridePrefix(ctx, prefix, true)
+		ctx = WithOverridePrefix(ctx, name, false)
+		assert.False(t, checkout.Enabled(ctx))
+		ctx = WithOverridePrefix(ctx, prefix, true)
+		assert.True(t, checkout.Enabled(ctx))
+	})
+
+	t.Run("beats global override", func(t *testing.T) {
+		SetGlobalOverride(search, true)
+		defer ClearGlobalOverride(search)
+		assert.False(t, search.Enabled(WithOverridePrefix(ctx, "", false)))
+	})
+}
+
+func TestFeatureOverrideString(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("positive", func(t *testing.T) {
+		f := NewFeature(t.Name())
+		ctx := WithOverrideString(ctx, "Foo", "Foo1,Foo"+t.Name())
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("wrong casing", func(t *testing.T) {
+		f := NewFeature(t.Name())
+		ctx := WithOverrideString(ctx, "Foo", "Foo1,Foo"+strings.ToUpper(t.Name()))
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		f := NewFeature(t.Name())
+		ctx := WithOverrideString(ctx, "Foo", "Foo1,FooAlso")
+		assert.False(t, f.Enabled(ctx))
+	})
+}
+
+func TestDecisions(t *testing.T) {
+	ctx := context.Background()
+	key, value := Key("test-key"), "test-value"
+	a := NewFeature(t.Name()+"A", WithExactMatch(key, value))
+	b := NewFeature(t.Name()+"B", WithDefaultEnabled())
+	c := NewFeature(t.Name() + "C")
+
+	encoded := EncodeDecisions(WithValue(ctx, key, value), a, b, c)
+	assert.Equal(t, a.name+","+b.name+",!"+c.name, encoded)
+
+	t.Run("round trip", func(t *testing.T) {
+		ctx := WithDecisions(ctx, encoded)
+		assert.True(t, a.Enabled(ctx))
+		assert.True(t, b.Enabled(ctx))
+		assert.False(t, c.Enabled(ctx))
+	})
+
+	t.Run("propagated states win", func(t *testing.T) {
+		ctx := WithDecisions(ctx, EncodeDecisions(ctx, a, b))
+		assert.False(t, a.Enabled(WithValue(ctx, key, value)))
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		assert.Equal(t, encoded, EncodeDecisions(WithDryRun(WithValue(ctx, key, value)), a, b, c))
+	})
+
+	t.Run("lenient parsing", func(t *testing.T) {
+		ctx := WithDecisions(ctx, " "+strings.ToUpper(a.name)+" ,,!,unknown")
+		assert.True(t, a.Enabled(ctx))
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		assert.Equal(t, "", EncodeDecisions(ctx))
+		assert.Equal(t, ctx, WithDecisions(ctx, ""))
+	})
+
+	t.Run("unknown features", func(t *testing.T) {
+		assert.Equal(t, ctx, WithDecisions(ctx, "!"+t.Name()+",unknown"))
+	})
+
+	t.Run("names that can't be encoded", func(t *testing.T) {
+		comma := NewFeature(t.Name() + "A,B")
+		bang := NewFeature("!" + t.Name())
+		assert.Panics(t, func() { EncodeDecisions(ctx, a, comma) })
+		assert.Panics(t, func() { EncodeDecisions(ctx, bang) })
+	})
+}
+
+func TestFeatureOverrideFile(t *testing.T) {
+	ctx := context.Background()
+	enabled := NewFeature(t.Name() + "Enabled")
+	disabled := NewFeature(t.Name()+"Disabled", WithExactMatch(Key("test-key"), "test-value"))
+	malformed := NewFeature(t.Name() + "Malformed")
+
+	path := filepath.Join(t.TempDir(), ".coalmine-overrides")
+	err := os.WriteFile(path, []byte(t.Name()+"Enabled=true\n"+
+		t.Name()+"Disabled = false\n"+
+		t.Name()+"Malformed\n"+
+		t.Name()+"Malformed=maybe\n"+
+		"=true\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err = WithOverrideFile(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("enable", func(t *testing.T) {
+		assert.True(t, enabled.Enabled(ctx))
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		ctx := WithValue(ctx, Key("test-key"), "test-value")
+		assert.False(t, disabled.Enabled(ctx))
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		assert.False(t, malformed.Enabled(ctx))
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := WithOverrideFile(ctx, filepath.Join(t.TempDir(), "missing"))
+		assert.NoError(t, err)
+	})
+}
+
+func TestFeatureDuplicateName(t *testing.T) {
+	NewFeature("FeatureName")
+	assert.Panics(t, func() {
+		NewFeature("featureName")
+	})
+}
+
+func TestFeatureClone(t *testing.T) {
+	ctx := context.Background()
+	key, groupKey := Key("test-key"), Key("group-key")
+	g := NewGroup(t.Name()+"Group", WithKeyPresent(groupKey))
+	f := g.NewFeature(t.Name(), WithOR(WithExactMatch(key, "a"), WithPercentage(key, 50)), WithAlias(t.Name()+"Alias"))
+	clone := f.Clone(t.Name() + "Clone")
+
+	t.Run("evaluates identically", func(t *testing.T) {
+		for _, ctx := range []context.Context{ctx, WithValue(ctx, groupKey, "")} {
+			for i := 0; i < 100; i++ {
+				ctx := WithValue(ctx, key, strconv.Itoa(i))
+				assert.Equal(t, f.Enabled(ctx), clone.Enabled(ctx), "value %d", i)
+			}
+		}
+	})
+
+	t.Run("registered", func(t *testing.T) {
+		assert.Same(t, clone, lookupFeature(clone.name))
+		assert.Same(t, f, lookupFeature(f.name))
+		assert.Panics(t, func() { f.Clone(f.name) })
+	})
+
+	t.Run("configuration copied", func(t *testing.T) {
+		f := NewFeature(t.Name()+"Original", WithDefaultEnabled())
+		assert.True(t, f.Clone(t.Name()+"Enabled").Enabled(ctx))
+		f = NewFeature(t.Name()+"DisabledOriginal", WithDefaultEnabled(), WithDisabled())
+		assert.False(t, f.Clone(t.Name()+"Disabled").Enabled(ctx))
+	})
+
+	t.Run("aliases not copied", func(t *testing.T) {
+		ctx := WithOverrideName(ctx, f.name+"Alias", true)
+		assert.True(t, f.Enabled(ctx))
+		assert.False(t, clone.Enabled(ctx))
+	})
+
+	t.Run("independent", func(t *testing.T) {
+		c := f.Clone(t.Name())
+		c.SetMatchers(WithExactMatch(key, "b"))
+		ctx := WithValue(ctx, groupKey, "")
+		assert.True(t, f.Enabled(WithValue(ctx, key, "a")))
+		assert.False(t, c.Enabled(WithValue(ctx, key, "a")))
+		assert.True(t, c.Enabled(WithValue(ctx, key, "b")))
+		assert.NotSame(t, f.gate, c.gate)
+	})
+
+	t.Run("sticky assignments use the clone's name", func(t *testing.T) {
+		store := &memoryAssignmentStore{assignments: map[string]bool{}}
+		f := NewFeature(t.Name()+"Original", WithStickyPercentage(store, key, 100))
+		c := f.Clone(t.Name())
+		assert.True(t, c.Enabled(WithValue(ctx, key, "a")))
+		assert.Equal(t, map[string]bool{c.name + "/a": true}, store.assignments)
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	region, tenant := Key("region"), Key("tenant")
+	g := NewGroup(t.Name()+"Group", WithKeyPresent(Key("internal")))
+	f := g.NewFeature(t.Name(),
+		WithOR(WithExactMatch(region, "westus"), WithAtLeastN(1, WithPercentage(tenant, 10))),
+		WithNOT(WithValueOneOf(region, "a", "b")),
+		WithAlias(t.Name()+"Alias"),
+		WithDefaultEnabled())
+	plain := NewFeature(t.Name() + "Plain")
+
+	infos := map[string]FeatureInfo{}
+	for _, info := range Registry() {
+		infos[info.Name] = info
+	}
+
+	t.Run("matchers", func(t *testing.T) {
+		info, ok := infos[f.name]
+		if !assert.True(t, ok) {
+			return
+		}
+		assert.Equal(t, []string{f.name + "Alias"}, info.Aliases)
+		assert.True(t, info.DefaultEnabled)
+		assert.False(t, info.Disabled)
+		assert.Nil(t, info.Expiry)
+		assert.Equal(t, []Key{"internal", region, tenant}, info.Keys)
+		assert.JSONEq(t, `{"kind":"or","matchers":[{"kind":"key_present","keys":["internal"]}]}`, string(info.Gate))
+		assert.JSONEq(t, `[
+			{"kind":"or","matchers":[
+				{"kind":"exact_match","keys":["region"],"args":["westus"]},
+				{"kind":"at_least_n","args":[1],"matchers":[{"kind":"percentage","keys":["tenant"],"args":[10]}]}
+			]},
+			{"kind":"not","matchers":[{"kind":"value_one_of","keys":["region"],"args":[["a","b"]]}]}
+		]`, string(info.Matchers))
+	})
+
+	t.Run("no matchers", func(t *testing.T) {
+		info := infos[plain.name]
+		assert.Equal(t, plain.name, info.Name)
+		assert.Nil(t, info.Gate)
+		assert.JSONEq(t, `[]`, string(info.Matchers))
+		assert.Empty(t, info.Keys)
+	})
+
+	t.Run("every feature", func(t *testing.T) {
+		registry.Range(func(key, value interface{}) bool {
+			assert.Contains(t, infos, value.(*Feature).name)
+			return true
+		})
+	})
+
+	t.Run("sorted", func(t *testing.T) {
+		infos := Registry()
+		for i := 1; i < len(infos); i++ {
+			assert.Less(t, infos[i-1].Name, infos[i].Name)
+		}
+	})
+}
+
+func TestSnapshotAll(t *testing.T) {
+	ctx := context.Background()
+	key, value := Key("test-key"), "test-value"
+	matched := NewFeature(t.Name()+"Matched", WithExactMatch(key, value))
+	unmatched := NewFeature(t.Name()+"Unmatched", WithExactMatch(key, "wrong value"))
+	overridden := NewFeature(t.Name()+"Overridden", WithExactMatch(key, value))
+
+	ctx = WithValue(ctx, key, value)
+	ctx = WithOverride(ctx, overridden, false)
+
+	observed := map[string]bool{}
+	ctx = WithObserver(ctx, func(ctx context.Context, feature string, state bool) {
+		observed[feature] = state
+	})
+
+	snapshot := SnapshotAll(ctx)
+	assert.Equal(t, observed, snapshot)
+	assert.Equal(t, true, snapshot[matched.name])
+	assert.Equal(t, false, snapshot[unmatched.name])
+	assert.Equal(t, false, snapshot[overridden.name])
+}
+
+func TestEnabledByName(t *testing.T) {
+	ctx := context.Background()
+	key, value := Key("test-key"), "test-value"
+	f := NewFeature(t.Name(), WithExactMatch(key, value))
+
+	t.Run("found", func(t *testing.T) {
+		state, found := EnabledByName(WithValue(ctx, key, value), f.name)
+		assert.True(t, found)
+		assert.True(t, state)
+
+		state, found = EnabledByName(ctx, f.name)
+		assert.True(t, found)
+		assert.False(t, state)
+	})
+
+	t.Run("wrong casing", func(t *testing.T) {
+		state, found := EnabledByName(WithValue(ctx, key, value), strings.ToUpper(f.name))
+		assert.True(t, found)
+		assert.True(t, state)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		state, found := EnabledByName(ctx, "does not exist")
+		assert.False(t, found)
+		assert.False(t, state)
+	})
+}
+
+func TestDefineKey(t *testing.T) {
+	t.Run("no collision", func(t *testing.T) {
+		key := DefineKey(t.Name())
+		assert.Equal(t, Key(t.Name()), key)
+		assert.Equal(t, key, DefineKey(t.Name()))
+	})
+
+	t.Run("feature defined first", func(t *testing.T) {
+		NewFeature(t.Name())
+		assert.Panics(t, func() {
+			DefineKey(strings.ToUpper(t.Name()))
+		})
+	})
+
+	t.Run("key defined first", func(t *testing.T) {
+		DefineKey(t.Name())
+		assert.Panics(t, func() {
+			NewFeature(strings.ToUpper(t.Name()))
+		})
+	})
+}
+
+func TestFeatureObserver(t *testing.T) {
+	ctx := context.Background()
+	f := NewFeature(t.Name())
+
+	t.Run("enabled", func(t *testing.T) {
+		ctx := WithOverride(ctx, f, true)
+		called := false
+		ctx = WithObserver(ctx, func(ctx context.Context, feat string, state bool) {
+			called = true
+			assert.Equal(t, f.name, feat)
+			assert.True(t, state)
+		})
+		f.Enabled(ctx)
+		assert.True(t, called)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		called := false
+		ctx := WithObserver(ctx, func(ctx context.Context, feat string, state bool) {
+			called = true
+			assert.Equal(t, f.name, feat)
+			assert.False(t, state)
+		})
+		f.Enabled(ctx)
+		assert.True(t, called)
+	})
+}
+
+func TestFeatureDisabled(t *testing.T) {
+	ctx := context.Background()
+	key, value := Key("test-key"), "test-value"
+	f := NewFeature(t.Name(), WithExactMatch(key, value), WithDisabled())
+
+	t.Run("matching value", func(t *testing.T) {
+		ctx := WithValue(ctx, key, value)
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("no value", func(t *testing.T) {
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("override on", func(t *testing.T) {
+		ctx := WithOverride(ctx, f, true)
+		assert.True(t, f.Enabled(ctx))
+	})
+}
+
+func TestFeatureExpiry(t *testing.T) {
+	ctx := context.Background()
+	expiry := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFeature(t.Name(), WithExpiry(expiry), WithDefaultEnabled())
+
+	clock := expiry.Add(-time.Second)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	t.Run("before", func(t *testing.T) {
+		clock = expiry.Add(-time.Second)
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("at", func(t *testing.T) {
+		clock = expiry
+		d := &Decision{}
+		assert.False(t, f.Enabled(WithDecisionSink(ctx, d)))
+		assert.Equal(t, ReasonExpired, d.Reason)
+	})
+
+	t.Run("after", func(t *testing.T) {
+		clock = expiry.Add(time.Hour)
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("override", func(t *testing.T) {
+		clock = expiry.Add(time.Hour)
+		assert.True(t, f.Enabled(WithOverride(ctx, f, true)))
+	})
+
+	t.Run("metric", func(t *testing.T) {
+		assert.Equal(t, float64(expiry.Unix()), testutil.ToFloat64(expiryMetric.WithLabelValues(f.name)))
+	})
+
+	t.Run("duplicate name", func(t *testing.T) {
+		assert.Panics(t, func() { NewFeature(f.name, WithExpiry(expiry.Add(time.Hour))) })
+		assert.Equal(t, float64(expiry.Unix()), testutil.ToFloat64(expiryMetric.WithLabelValues(f.name)))
+	})
+}
+
+func TestFeatureDefaultEnabled(t *testing.T) {
+	ctx := context.Background()
+	f := NewFeature(t.Name(), WithDefaultEnabled())
+
+	t.Run("default", func(t *testing.T) {
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("override off", func(t *testing.T) {
+		ctx := WithOverride(ctx, f, false)
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("override loop off", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "overrides")
+		if err := os.WriteFile(path, []byte(f.name+"=off"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		loop := NewOverrideLoop(path, time.Hour, nil)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		if err := loop.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, f.Enabled(WithOverrideLoop(ctx, loop)))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		f := NewFeature(t.Name(), WithDefaultEnabled(), WithDisabled())
+		assert.False(t, f.Enabled(ctx))
+	})
+}
+
+func TestFeatureAlias(t *testing.T) {
+	ctx := context.Background()
+	f := NewFeature(t.Name(), WithAlias("OldName", "older-name"))
+
+	t.Run("old name", func(t *testing.T) {
+		ctx := WithOverrideString(ctx, "", "oldname")
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("second alias", func(t *testing.T) {
+		ctx := WithOverrideString(ctx, "", "foo,Older-Name")
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("new name", func(t *testing.T) {
+		ctx := WithOverrideString(ctx, "", t.Name())
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("unrelated name", func(t *testing.T) {
+		ctx := WithOverrideString(ctx, "", "something-else")
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("lookup", func(t *testing.T) {
+		assert.Same(t, f, lookupFeature("OLDNAME"))
+		_, found := EnabledByName(ctx, "older-name")
+		assert.True(t, found)
+	})
+
+	t.Run("collisions", func(t *testing.T) {
+		assert.PanicsWithError(t, `a coalmine feature with the name "oldname" already exists`, func() { NewFeature("oldname") })
+		assert.PanicsWithError(t, `a coalmine feature with the name "OldName" already exists`, func() { NewFeature(t.Name(), WithAlias("OldName")) })
+		assert.PanicsWithError(t, `a coalmine feature with the name "TestFeatureAlias" already exists`, func() { NewFeature(t.Name(), WithAlias("TestFeatureAlias")) })
+		assert.PanicsWithError(t, `a coalmine feature with the name "older-name" already exists`, func() { DefineKey("older-name") })
+		assert.Nil(t, lookupFeature(t.Name()), "nothing is registered when an alias collides")
+	})
+
+	t.Run("key collision", func(t *testing.T) {
+		DefineKey(t.Name() + "Key")
+		assert.PanicsWithError(t, `a coalmine key with the name "TestFeatureAlias/key_collisionKey" already exists`, func() {
+			NewFeature(t.Name(), WithAlias(t.Name()+"Key"))
+		})
+	})
+}
+
+func TestFeatureEvaluationLatencyMetric(t *testing.T) {
+	ctx := context.Background()
+	f := NewFeature(t.Name(), WithExactMatch(Key("test-key"), "test-value"))
+
+	t.Run("disabled", func(t *testing.T) {
+		f.Enabled(ctx)
+		assert.Equal(t, uint64(0), evaluationCount(t, f.name))
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		SetEvaluationLatencyMetric(true)
+		defer SetEvaluationLatencyMetric(false)
+
+		f.Enabled(ctx)
+		assert.Equal(t, uint64(1), evaluationCount(t, f.name))
+		f.Enabled(ctx)
+		assert.Equal(t, uint64(2), evaluationCount(t, f.name))
+	})
+}
+
+func evaluationCount(t *testing.T, feature string) uint64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "coalmine_feature_evaluate_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "feature" && label.GetValue() == feature {
+					return metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestFeatureEvaluationTimeout(t *testing.T) {
+	ctx := WithEvaluationTimeout(context.Background(), 10*time.Millisecond)
+	key := Key("test-key")
+	slow := NewFeature(t.Name()+"Slow", WithValueFunc(key, func(string) bool {
+		time.Sleep(time.Second)
+		return true
+	}))
+	fast := NewFeature(t.Name()+"Fast", WithExactMatch(key, "test-value"))
+	timeouts := func() float64 { return testutil.ToFloat64(timeoutMetric.WithLabelValues(slow.name)) }
+
+	t.Run("timeout", func(t *testing.T) {
+		before := timeouts()
+		start := time.Now()
+		assert.False(t, slow.Enabled(ctx))
+		assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond))
+		assert.Equal(t, before+1, timeouts())
+	})
+
+	t.Run("timeout not cached", func(t *testing.T) {
+		ctx := WithEvaluationCache(ctx)
+		assert.False(t, slow.Enabled(ctx))
+		_, present := getEvaluationCache(ctx).load(slow)
+		assert.False(t, present)
+	})
+
+	// The remaining matchers return immediately, so a generous timeout keeps them from flaking on slow machines
+	ctx = WithEvaluationTimeout(context.Background(), time.Second)
+
+	t.Run("within timeout", func(t *testing.T) {
+		assert.True(t, fast.Enabled(WithValue(ctx, key, "test-value")))
+		assert.False(t, fast.Enabled(ctx))
+	})
+
+	t.Run("missing keys reported", func(t *testing.T) {
+		_, err := fast.EnabledStrict(ctx)
+		assert.ErrorIs(t, err, ErrMissingKey)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		f := NewFeature(t.Name(), WithValueFunc(key, func(string) bool { panic("test panic") }))
+		d := &Decision{}
+		assert.True(t, f.EnabledOr(WithDecisionSink(ctx, d), true))
+		assert.Equal(t, ReasonPanic, d.Reason)
+	})
+}
+
+func TestFeatureEvaluationCache(t *testing.T) {
+	calls := 0
+	f := NewFeature(t.Name(), func(f *Feature) *matcher {
+		return &matcher{fn: func(ctx context.Context) bool {
+			calls++
+			return true
+		}}
+	})
+
+	observed := 0
+	ctx := WithObserver(context.Background(), func(ctx context.Context, feature string, state bool) {
+		observed++
+	})
+	ctx = WithEvaluationCache(ctx)
+
+	assert.True(t, f.Enabled(ctx))
+	assert.True(t, f.Enabled(ctx))
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 2, observed)
+
+	t.Run("override still applies", func(t *testing.T) {
+		ctx := WithOverride(ctx, f, false)
+		assert.False(t, f.Enabled(ctx))
+	})
+
+	t.Run("without cache", func(t *testing.T) {
+		calls = 0
+		f.Enabled(context.Background())
+		f.Enabled(context.Background())
+		assert.Equal(t, 2, calls)
+	})
+}
+
+func TestFeatureDecisionSink(t *testing.T) {
+	ctx := context.Background()
+	key, value, value2 := Key("test-key"), "test-value", "test-value-2"
+	f := NewFeature(t.Name(), WithExactMatch(key, value), WithExactMatch(key, value2))
+
+	t.Run("first matcher", func(t *testing.T) {
+		d := &Decision{}
+		ctx := WithDecisionSink(WithValue(ctx, key, value), d)
+		assert.True(t, f.Enabled(ctx))
+		assert.Equal(t, Decision{Feature: f.name, State: true, Reason: ReasonMatcher, Matcher: 0}, *d)
+	})
+
+	t.Run("second matcher", func(t *testing.T) {
+		d := &Decision{}
+		ctx := WithDecisionSink(WithValue(ctx, key, value2), d)
+		assert.True(t, f.Enabled(ctx))
+		assert.Equal(t, Decision{Feature: f.name, State: true, Reason: ReasonMatcher, Matcher: 1}, *d)
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		d := &Decision{}
+		ctx := WithDecisionSink(ctx, d)
+		assert.False(t, f.Enabled(ctx))
+		assert.Equal(t, Decision{Feature: f.name, State: false, Reason: ReasonDefault, Matcher: -1}, *d)
+	})
+
+	t.Run("override", func(t *testing.T) {
+		d := &Decision{}
+		ctx := WithDecisionSink(WithOverride(ctx, f, true), d)
+		assert.True(t, f.Enabled(ctx))
+		assert.Equal(t, Decision{Feature: f.name, State: true, Reason: ReasonOverride, Matcher: -1}, *d)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		f := NewFeature(t.Name(), WithExactMatch(key, value), WithDisabled())
+		d := &Decision{}
+		ctx := WithDecisionSink(WithValue(ctx, key, value), d)
+		assert.False(t, f.Enabled(ctx))
+		assert.Equal(t, Decision{Feature: f.name, State: false, Reason: ReasonDisabled, Matcher: -1}, *d)
+	})
+}
+
+func TestFeatureEnabledMetric(t *testing.T) {
+	ctx := context.Background()
+	key, value := Key("test-key"), "test-value"
+	f := NewFeature(t.Name(), WithExactMatch(key, value))
+	count := func(reason Reason) float64 {
+		return testutil.ToFloat64(enabledMetric.WithLabelValues(f.name, string(reason)))
+	}
+
+	t.Run("matcher", func(t *testing.T) {
+		assert.True(t, f.Enabled(WithValue(ctx, key, value)))
+		assert.Equal(t, float64(1), count(ReasonMatcher))
+	})
+
+	t.Run("override", func(t *testing.T) {
+		assert.True(t, f.Enabled(WithOverride(ctx, f, true)))
+		assert.Equal(t, float64(1), count(ReasonOverride))
+	})
+
+	t.Run("global override", func(t *testing.T) {
+		SetGlobalOverride(f, true)
+		defer ClearGlobalOverride(f)
+		assert.True(t, f.Enabled(ctx))
+		assert.Equal(t, float64(1), count(ReasonGlobalOverride))
+	})
+
+	t.Run("disabled by override", func(t *testing.T) {
+		assert.False(t, f.Enabled(WithOverride(WithValue(ctx, key, value), f, false)))
+		assert.Equal(t, float64(1), count(ReasonOverride))
+		assert.Equal(t, float64(1), count(ReasonMatcher))
+	})
+
+	t.Run("not enabled", func(t *testing.T) {
+		assert.False(t, f.Enabled(ctx))
+		assert.Equal(t, float64(0), count(ReasonDefault))
+	})
+}
+
+func TestFeatureProbe(t *testing.T) {
+	ctx := context.Background()
+	key, value := Key("test-key"), "test-value"
+	f := NewFeature(t.Name(), WithExactMatch(key, value))
+	count := func() float64 {
+		return testutil.ToFloat64(enabledMetric.WithLabelValues(f.name, string(ReasonMatcher)))
+	}
+
+	var observed, hooked int
+	ctx = WithValue(ctx, key, value)
+	ctx = WithObserver(ctx, func(ctx context.Context, feature string, state bool) { observed++ })
+	ctx = WithMetricsHook(ctx, func(feature string, state bool, reason Reason) { hooked++ })
+
+	t.Run("probe", func(t *testing.T) {
+		assert.True(t, f.Probe(ctx))
+		assert.False(t, f.Probe(WithValue(ctx, key, "other")))
+		assert.Equal(t, float64(0), count())
+		assert.Equal(t, 0, observed)
+		assert.Equal(t, 0, hooked)
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		assert.True(t, f.Enabled(ctx))
+		assert.Equal(t, float64(1), count())
+		assert.Equal(t, 1, observed)
+		assert.Equal(t, 1, hooked)
+	})
+
+	t.Run("override", func(t *testing.T) {
+		assert.False(t, f.Probe(WithOverride(ctx, f, false)))
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		assert.False(t, f.Probe(WithDryRun(ctx)))
+	})
+
+	t.Run("sticky assignments", func(t *testing.T) {
+		store := &memoryAssignmentStore{assignments: map[string]bool{}}
+		sticky := NewFeature(t.Name(), WithStickyPercentage(store, key, 100))
+		assert.True(t, sticky.Probe(ctx))
+		assert.Empty(t, store.assignments)
+
+		assert.True(t, sticky.Enabled(ctx))
+		assert.Equal(t, map[string]bool{sticky.name + "/" + value: true}, store.assignments)
+	})
+
+	t.Run("evaluation cache", func(t *testing.T) {
+		ctx := WithEvaluationCache(ctx)
+		assert.False(t, f.Probe(WithValue(ctx, key, "other")))
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("panic metric", func(t *testing.T) {
+		panicky := NewFeature(t.Name(), func(f *Feature) *matcher {
+			return &matcher{fn: func(ctx context.Context) bool { panic("test") }}
+		})
+		assert.False(t, panicky.Probe(ctx))
+		assert.Equal(t, float64(0), testutil.ToFloat64(panicMetric.WithLabelValues(panicky.name)))
+	})
+}
+
+func TestPublishExpvar(t *testing.T) {
+	ctx := context.Background()
+	key, value := Key("test-key"), "test-value"
+	before := NewFeature(t.Name()+"Before", WithExactMatch(key, value))
+	PublishExpvar()
+	PublishExpvar()
+	after := NewFeature(t.Name()+"After", WithDisabled())
+
+	read := func(f *Feature) featureVars {
+		v := expvar.Get("coalmine").(*expvar.Map).Get(f.name)
+		if !assert.NotNil(t, v) {
+			return featureVars{}
+		}
+		var vars featureVars
+		assert.NoError(t, json.Unmarshal([]byte(v.String()), &vars))
+		return vars
+	}
+
+	t.Run("enables", func(t *testing.T) {
+		assert.True(t, before.Enabled(WithValue(ctx, key, value)))
+		assert.True(t, before.Enabled(WithOverride(ctx, before, true)))
+		assert.False(t, before.Enabled(ctx))
+		assert.Equal(t, featureVars{Enables: 2}, read(before))
+	})
+
+	t.Run("global override", func(t *testing.T) {
+		SetGlobalOverride(before, false)
+		defer ClearGlobalOverride(before)
+		enabled := false
+		assert.Equal(t, featureVars{Enables: 2, GlobalOverride: &enabled}, read(before))
+	})
+
+	t.Run("feature allocated after publishing", func(t *testing.T) {
+		assert.Equal(t, featureVars{Disabled: true}, read(after))
+	})
+}
+
+func TestFuncMap(t *testing.T) {
+	ctx := context.Background()
+	on := NewFeature(t.Name()+"On", WithDefaultEnabled())
+	off := NewFeature(t.Name() + "Off")
+	funcs := FuncMap(ctx, on, off)
+	const src = `{{if enabled "TestFuncMapOn"}}on{{else}}not on{{end}} {{if enabled "testfuncmapoff"}}off{{else}}not off{{end}}`
+
+	t.Run("text", func(t *testing.T) {
+		tmpl := texttemplate.Must(texttemplate.New("").Funcs(funcs).Parse(src))
+		var buf bytes.Buffer
+		assert.NoError(t, tmpl.Execute(&buf, nil))
+		assert.Equal(t, "on not off", buf.String())
+	})
+
+	t.Run("html", func(t *testing.T) {
+		tmpl := htmltemplate.Must(htmltemplate.New("").Funcs(htmltemplate.FuncMap(funcs)).Parse(src))
+		var buf bytes.Buffer
+		assert.NoError(t, tmpl.Execute(&buf, nil))
+		assert.Equal(t, "on not off", buf.String())
+	})
+
+	t.Run("unknown feature", func(t *testing.T) {
+		tmpl := texttemplate.Must(texttemplate.New("").Funcs(funcs).Parse(`{{if enabled "missing"}}{{end}}`))
+		err := tmpl.Execute(&bytes.Buffer{}, nil)
+		assert.Contains(t, err.Error(), `coalmine feature "missing" was not provided to FuncMap`)
+	})
+}
+
+func TestFeatureMetricSampling(t *testing.T) {
+	ctx := context.Background()
+	const n = 10000
+
+	for _, rate := range []float64{0.1, 0.25, 1, 2} {
+		rate := rate
+		t.Run(strconv.FormatFloat(rate, 'f', -1, 64), func(t *testing.T) {
+			f := NewFeature(t.Name(), WithMetricSampling(rate))
+			ctx := WithOverride(ctx, f, true)
+			for i := 0; i < n; i++ {
+				f.Enabled(ctx)
+			}
+			assert.InDelta(t, n, testutil.ToFloat64(enabledMetric.WithLabelValues(f.name, string(ReasonOverride))), 1e-6*n)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		f := NewFeature(t.Name(), WithMetricSampling(0))
+		assert.True(t, f.Enabled(WithOverride(ctx, f, true)))
+		assert.Equal(t, float64(0), testutil.ToFloat64(enabledMetric.WithLabelValues(f.name, string(ReasonOverride))))
+	})
+}
+
+func TestFeatureMetricsHook(t *testing.T) {
+	ctx := context.Background()
+	key, value := Key("test-key"), "test-value"
+	f := NewFeature(t.Name(), WithExactMatch(key, value))
+	disabled := NewFeature(t.Name()+"Disabled", WithDisabled())
+
+	type call struct {
+		feature string
+		enabled bool
+		reason  Reason
+	}
+	var calls []call
+	ctx = WithMetricsHook(ctx, func(feature string, enabled bool, reason Reason) {
+		calls = append(calls, call{feature, enabled, reason})
+	})
+
+	f.Enabled(ctx)
+	f.Enabled(WithValue(ctx, key, value))
+	f.Enabled(WithOverride(ctx, f, false))
+	SetGlobalOverride(f, true)
+	f.Enabled(ctx)
+	ClearGlobalOverride(f)
+	disabled.Enabled(ctx)
+
+	assert.Equal(t, []call{
+		{f.name, false, ReasonDefault},
+		{f.name, true, ReasonMatcher},
+		{f.name, false, ReasonOverride},
+		{f.name, true, ReasonGlobalOverride},
+		{disabled.name, false, ReasonDisabled},
+	}, calls)
+}
+
+func TestJSONObserver(t *testing.T) {
+	buf := &bytes.Buffer{}
+	ctx := WithObserver(context.Background(), JSONObserver(buf))
+	f := NewFeature(t.Name())
+	ctx = WithOverride(ctx, f, true)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.Enabled(ctx)
+		}()
+	}
+	wg.Wait()
+
+	lines := 0
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		lines++
+		entry := map[string]interface{}{}
+		if assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry)) {
+			assert.Equal(t, f.name, entry["feature"])
+			assert.Equal(t, true, entry["enabled"])
+			assert.NotEmpty(t, entry["ts"])
+		}
+	}
+	assert.Equal(t, 10, lines)
+}
+
+func TestSampledObserver(t *testing.T) {
+	ctx := context.Background()
+	const n = 10000
+
+	for _, rate := range []float64{-1, 0, 0.01, 0.25, 0.5, 1, 2} {
+		rate := rate
+		t.Run(strconv.FormatFloat(rate, 'f', -1, 64), func(t *testing.T) {
+			var calls int64
+			var mut sync.Mutex
+			observer := SampledObserver(rate, func(ctx context.Context, feature string, state bool) {
+				mut.Lock()
+				defer mut.Unlock()
+				calls++
+			})
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < n/10; j++ {
+						observer(ctx, t.Name(), true)
+					}
+				}()
+			}
+			wg.Wait()
+
+			expected := rate * n
+			if expected < 0 {
+				expected = 0
+			} else if expected > n {
+				expected = n
+			}
+			assert.Equal(t, int64(expected), calls)
+		})
+	}
+}
+
+func TestFeatureObserverPanic(t *testing.T) {
+	ctx := WithObserver(context.Background(), func(ctx context.Context, feature string, state bool) {
+		panic("test panic")
+	})
+	f := NewFeature(t.Name(), WithExactMatch(Key("test-key"), "test-value"))
+	panics := func() float64 { return testutil.ToFloat64(observerPanicMetric.WithLabelValues(f.name)) }
+
+	before := panics()
+	assert.False(t, f.Enabled(ctx))
+	assert.True(t, f.Enabled(WithValue(ctx, Key("test-key"), "test-value")))
+	assert.Equal(t, before+2, panics())
+}
+
+func TestFeatureWithoutObserver(t *testing.T) {
+	ctx := context.Background()
+	f := NewFeature(t.Name(), WithPercentage(Key("test-key"), 50))
+
+	called := false
+	ctx = WithObserver(ctx, func(ctx context.Context, feat string, state bool) {
+		called = true
+	})
+
+	t.Run("suppressed", func(t *testing.T) {
+		ctx := WithoutObserver(ctx)
+		f.Enabled(ctx)
+		f.Preview(ctx, Key("test-key"), []string{"1", "2", "3"})
+		assert.False(t, called)
+	})
+
+	t.Run("parent unaffected", func(t *testing.T) {
+		f.Enabled(ctx)
+		assert.True(t, called)
+	})
+}
+
+func TestFeatureObserverChain(t *testing.T) {
+	ctx := context.Background()
+	f := NewFeature(t.Name())
+	ctx = WithOverride(ctx, f, true)
+
+	calls := []string{}
+	observer := func(name string) ObserverFunc {
+		return func(ctx context.Context, feat string, state bool) {
+			calls = append(calls, name)
+			assert.Equal(t, f.name, feat)
+			assert.True(t, state)
+		}
+	}
+
+	t.Run("chain", func(t *testing.T) {
+		calls = nil
+		ctx := WithObserverChain(ctx, observer("first"), observer("second"))
+		f.Enabled(ctx)
+		assert.Equal(t, []string{"first", "second"}, calls)
+	})
+
+	t.Run("appends to existing", func(t *testing.T) {
+		calls = nil
+		ctx := WithObserver(ctx, observer("first"))
+		ctx = WithObserverChain(ctx, observer("second"))
+		f.Enabled(ctx)
+		assert.Equal(t, []string{"first", "second"}, calls)
+	})
+
+	t.Run("WithObserver replaces", func(t *testing.T) {
+		calls = nil
+		ctx := WithObserverChain(ctx, observer("first"))
+		ctx = WithObserver(ctx, observer("second"))
+		f.Enabled(ctx)
+		assert.Equal(t, []string{"second"}, calls)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		calls = nil
+		panics := func() float64 { return testutil.ToFloat64(observerPanicMetric.WithLabelValues(f.name)) }
+		before := panics()
+		ctx := WithObserverChain(ctx, observer("first"), func(ctx context.Context, feat string, state bool) {
+			panic("test panic")
+		}, observer("second"))
+		assert.True(t, f.Enabled(ctx))
+		assert.Equal(t, []string{"first", "second"}, calls)
+		assert.Equal(t, before+1, panics())
+	})
+}
+
+func TestFeatureEnabledOr(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	f := NewFeature(t.Name(), WithValueFunc(key, func(value string) bool {
+		if value == "" {
+			panic("value is required")
+		}
+		return true
+	}))
+	panics := func() float64 { return testutil.ToFloat64(panicMetric.WithLabelValues(f.name)) }
+
+	t.Run("fallback on", func(t *testing.T) {
+		before := panics()
+		assert.True(t, f.EnabledOr(ctx, true))
+		assert.Equal(t, before+1, panics())
+	})
+
+	t.Run("fallback off", func(t *testing.T) {
+		before := panics()
+		assert.False(t, f.EnabledOr(ctx, false))
+		assert.Equal(t, before+1, panics())
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		before := panics()
+		assert.False(t, f.Enabled(ctx))
+		assert.Equal(t, before+1, panics())
+	})
+
+	t.Run("no panic", func(t *testing.T) {
+		before := panics()
+		ctx := WithValue(ctx, key, "value")
+		assert.True(t, f.EnabledOr(ctx, false))
+		assert.Equal(t, before, panics())
+	})
+
+	t.Run("decision", func(t *testing.T) {
+		d := &Decision{}
+		f.EnabledOr(WithDecisionSink(ctx, d), true)
+		assert.Equal(t, Decision{Feature: f.name, State: true, Reason: ReasonPanic, Matcher: -1}, *d)
+	})
+}
+
+func TestMatcherMetric(t *testing.T) {
+	ctx := context.Background()
+	key, key2, value, value2 := Key("test-key"), Key("test-key-2"), "test-value", "test-value-2"
+	f := NewFeature(t.Name(),
+		WithAND(WithExactMatch(key, value), WithExactMatch(key2, value2)),
+		WithExactMatch(key, value2))
+	count := func(index string, result bool) float64 {
+		return testutil.ToFloat64(matcherMetric.WithLabelValues(f.name, index, strconv.FormatBool(result)))
+	}
+
+	f.Enabled(ctx) // not counted while disabled
+	SetMatcherMetric(true)
+	defer SetMatcherMetric(false)
+
+	f.Enabled(ctx)                                                       // first AND clause short circuits, OR falls through
+	f.Enabled(WithValue(ctx, key, value))                                // second AND clause short circuits, OR falls through
+	f.Enabled(WithValues(ctx, map[Key]string{key: value, key2: value2})) // first OR branch wins
+	f.Enabled(WithValue(ctx, key, value2))                               // second OR branch wins
+
+	assert.Equal(t, float64(1), count("0", true))
+	assert.Equal(t, float64(3), count("0", false))
+	assert.Equal(t, float64(2), count("0.0", true))
+	assert.Equal(t, float64(2), count("0.0", false))
+	assert.Equal(t, float64(1), count("0.1", true))
+	assert.Equal(t, float64(1), count("0.1", false))
+	assert.Equal(t, float64(1), count("1", true))
+	assert.Equal(t, float64(2), count("1", false))
+}
+
+func TestFeatureEnabledStrict(t *testing.T) {
+	ctx := context.Background()
+	key, key2 := Key("test-key"), Key("test-key-2")
+	f := NewFeature(t.Name(), WithAND(WithExactMatch(key, "value"), WithPercentage(key2, 100)))
+
+	t.Run("present", func(t *testing.T) {
+		ctx := WithValues(ctx, map[Key]string{key: "value", key2: "value"})
+		state, err := f.EnabledStrict(ctx)
+		assert.NoError(t, err)
+		assert.True(t, state)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		ctx := WithValue(ctx, key, "value")
+		state, err := f.EnabledStrict(ctx)
+		assert.True(t, errors.Is(err, ErrMissingKey))
+		assert.Contains(t, err.Error(), string(key2))
+		assert.True(t, state)
+	})
+
+	t.Run("set to empty", func(t *testing.T) {
+		ctx := WithValues(ctx, map[Key]string{key: "", key2: ""})
+		state, err := f.EnabledStrict(ctx)
+		assert.NoError(t, err)
+		assert.False(t, state)
+	})
+
+	t.Run("WithStrictKeys", func(t *testing.T) {
+		var reported []Key
+		ctx := WithStrictKeys(ctx, func(feature string, missing []Key) {
+			assert.Equal(t, f.name, feature)
+			reported = missing
+		})
+		assert.False(t, f.Enabled(ctx))
+		assert.Equal(t, []Key{key}, reported) // short circuited before key2
+	})
+}
+
+func TestGroup(t *testing.T) {
+	ctx := context.Background()
+	internal, key, value := Key("internal"), Key("test-key"), "test-value"
+	g := NewGroup(t.Name(), WithExactMatch(internal, "true"))
+	f := g.NewFeature(t.Name()+"Feature", WithExactMatch(key, value))
+	f2 := g.NewFeature(t.Name()+"Feature2", WithDefaultEnabled())
+
+	t.Run("gate and matcher", func(t *testing.T) {
+		ctx := WithValues(ctx, map[Key]string{internal: "true", key: value})
+		assert.True(t, f.Enabled(ctx))
+		assert.True(t, f2.Enabled(ctx))
+	})
+
+	t.Run("gate only", func(t *testing.T) {
+		ctx := WithValue(ctx, internal, "true")
+		assert.False(t, f.Enabled(ctx))
+		assert.True(t, f2.Enabled(ctx))
+	})
+
+	t.Run("matcher only", func(t *testing.T) {
+		d := &Decision{}
+		ctx := WithDecisionSink(WithValue(ctx, key, value), d)
+		assert.False(t, f.Enabled(ctx))
+		assert.Equal(t, ReasonGate, d.Reason)
+		assert.False(t, f2.Enabled(ctx))
+	})
+
+	t.Run("override", func(t *testing.T) {
+		ctx := WithOverride(ctx, f, true)
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("keys", func(t *testing.T) {
+		assert.Equal(t, []Key{internal, key}, f.Keys())
+	})
+
+	t.Run("no gate", func(t *testing.T) {
+		g := NewGroup(t.Name())
+		f := g.NewFeature(t.Name(), WithExactMatch(key, value))
+		assert.True(t, f.Enabled(WithValue(ctx, key, value)))
+	})
+}
+
+func TestSplit(t *testing.T) {
+	ctx := context.Background()
+	key := Key("test-key")
+	a := NewFeature(t.Name() + "A")
+	b := NewFeature(t.Name() + "B")
+	c := NewFeature(t.Name()+"C", WithExactMatch(Key("other-key"), "value"))
+	Split(t.Name(), key, map[*Feature]uint32{a: 10, b: 10, c: 80})
+
+	counts := map[*Feature]int{}
+	for i := 0; i < 10000; i++ {
+		ctx := WithValues(ctx, map[Key]string{key: strconv.Itoa(i), Key("other-key"): "value"})
+		enabled := 0
+		for _, f := range []*Feature{a, b, c} {
+			if f.Enabled(ctx) {
+				counts[f]++
+				enabled++
+			}
+		}
+		assert.Equal(t, 1, enabled, "value %d", i)
+	}
+	assert.InDelta(t, 1000, counts[a], 200)
+	assert.InDelta(t, 1000, counts[b], 200)
+	assert.InDelta(t, 8000, counts[c], 200)
+
+	t.Run("override", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			ctx := WithOverride(WithValue(ctx, key, strconv.Itoa(i)), a, true)
+			assert.True(t, a.Enabled(ctx))
+		}
+	})
+
+	t.Run("over 100 percent", func(t *testing.T) {
+		assert.Panics(t, func() {
+			Split(t.Name(), key, map[*Feature]uint32{NewFeature(t.Name() + "A"): 60, NewFeature(t.Name() + "B"): 60})
+		})
+	})
+
+	t.Run("SetMatchers", func(t *testing.T) {
+		tier := Key("tier")
+		a := NewFeature(t.Name() + "A")
+		b := NewFeature(t.Name() + "B")
+		Split(t.Name(), key, map[*Feature]uint32{a: 50, b: 50})
+
+		shares := map[*Feature]string{}
+		for i := 0; len(shares) < 2; i++ {
+			ctx := WithValue(ctx, key, strconv.Itoa(i))
+			for _, f := range []*Feature{a, b} {
+				if f.Enabled(ctx) {
+					shares[f] = strconv.Itoa(i)
+				}
+			}
+		}
+
+		a.SetMatchers(WithExactMatch(tier, "gold"))
+		assert.True(t, a.Enabled(WithValues(ctx, map[Key]string{key: shares[a], tier: "gold"})))
+		assert.False(t, a.Enabled(WithValue(ctx, key, shares[a])), "the split's matcher is replaced")
+		assert.False(t, a.Enabled(WithValues(ctx, map[Key]string{key: shares[b], tier: "gold"})), "the split's gate is preserved")
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	key, value := Key("test-key"), "test-value"
+	f := NewFeature(t.Name(), WithExactMatch(key, value))
+	global := NewFeature(t.Name() + "Global")
+	SetGlobalOverride(global, true)
+	defer ClearGlobalOverride(global)
+
+	buf := &bytes.Buffer{}
+	ctx := WithAuditLog(context.Background(), buf)
+	entries := func() []map[string]interface{} {
+		var entries []map[string]interface{}
+		dec := json.NewDecoder(buf)
+		for dec.More() {
+			entry := map[string]interface{}{}
+			if err := dec.Decode(&entry); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	t.Run("matcher", func(t *testing.T) {
+		f.Enabled(WithValue(ctx, key, value))
+		f.Enabled(ctx)
+		assert.Empty(t, entries())
+	})
+
+	t.Run("override", func(t *testing.T) {
+		f.Enabled(WithOverride(ctx, f, false))
+		e := entries()
+		if assert.Len(t, e, 1) {
+			assert.Equal(t, f.name, e[0]["feature"])
+			assert.Equal(t, "override", e[0]["reason"])
+			assert.Equal(t, false, e[0]["enabled"])
+			assert.NotEmpty(t, e[0]["ts"])
+		}
+	})
+
+	t.Run("global override", func(t *testing.T) {
+		global.Enabled(ctx)
+		e := entries()
+		if assert.Len(t, e, 1) {
+			assert.Equal(t, global.name, e[0]["feature"])
+			assert.Equal(t, "global_override", e[0]["reason"])
+			assert.Equal(t, true, e[0]["enabled"])
+		}
+	})
+}
+
+func TestFeatureDryRun(t *testing.T) {
+	ctx := context.Background()
+	key, value := Key("test-key"), "test-value"
+	f := NewFeature(t.Name(), WithExactMatch(key, value))
+
+	var observed *bool
+	ctx = WithObserver(ctx, func(ctx context.Context, feature string, state bool) {
+		observed = &state
+	})
+	ctx = WithDryRun(ctx)
+
+	t.Run("would be enabled", func(t *testing.T) {
+		before := testutil.ToFloat64(enabledMetric.WithLabelValues(f.name, string(ReasonMatcher)))
+		ctx := WithValue(ctx, key, value)
+		assert.False(t, f.Enabled(ctx))
+		assert.True(t, *observed)
+		assert.Equal(t, before+1, testutil.ToFloat64(enabledMetric.WithLabelValues(f.name, string(ReasonMatcher))))
+	})
+
+	t.Run("would be disabled", func(t *testing.T) {
+		assert.False(t, f.Enabled(ctx))
+		assert.False(t, *observed)
+	})
+
+	t.Run("override", func(t *testing.T) {
+		ctx := WithOverride(ctx, f, true)
+		assert.False(t, f.Enabled(ctx))
+		assert.True(t, *observed)
+	})
+}
+
+var benchmarkNoMatchersFeature = NewFeature("BenchmarkNoMatchers")
+
+func TestFeatureNoMatchersAllocations(t *testing.T) {
+	ctx := WithObserver(context.Background(), func(ctx context.Context, feature string, state bool) {})
+	allocs := testing.AllocsPerRun(100, func() {
+		benchmarkNoMatchersFeature.Enabled(ctx)
+	})
+	assert.Zero(t, allocs)
+}
+
+func BenchmarkNoMatchers(b *testing.B) {
+	ctx := WithObserver(context.Background(), func(ctx context.Context, feature string, state bool) {})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchmarkNoMatchersFeature.Enabled(ctx)
+	}
+}
+
+func BenchmarkMatcherTree(b *testing.B) {
+	region, tenant, internal := Key("region"), Key("tenant"), Key("internal")
+	m := WithOR(
+		WithAND(WithExactMatch(region, "westus"), WithPercentage(tenant, 50)),
+		WithAND(WithNOT(WithKeyPresent(internal)), WithExactMatchFold(region, "EASTUS")),
+	)(&Feature{name: "benchmark"})
+	m.setIndex("benchmark", "0")
+	ctx := WithValues(context.Background(), map[Key]string{"region": "eastus", "tenant": strconv.Itoa(3)})
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.evaluate(ctx)
+	}
+}
+
+func TestFeatureSetMatchers(t *testing.T) {
+	ctx := context.Background()
+	key, key2 := Key("test-key"), Key("test-key-2")
+	f := NewFeature(t.Name(), WithExactMatch(key, "value"))
+
+	t.Run("replace", func(t *testing.T) {
+		f.SetMatchers(WithExactMatch(key2, "value"))
+		assert.False(t, f.Enabled(WithValue(ctx, key, "value")))
+		assert.True(t, f.Enabled(WithValue(ctx, key2, "value")))
+		assert.Equal(t, []Key{key2}, f.Keys())
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		// Run with -race to detect unsynchronized access to the matchers
+		ctxA, ctxB, ctxC := WithValue(ctx, key, "a"), WithValue(ctx, key, "b"), WithValue(ctx, key, "c")
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					f.Enabled(ctxA)
+					f.Enabled(ctxB)
+					assert.False(t, f.Enabled(ctxC))
+				}
+			}()
+		}
+		for i := 0; i < 1000; i++ {
+			if i%2 == 0 {
+				f.SetMatchers(WithExactMatch(key, "a"))
+			} else {
+				f.SetMatchers(WithExactMatch(key, "b"), WithExactMatch(key2, "b"))
+			}
+		}
+		close(done)
+		wg.Wait()
+
+		assert.False(t, f.Enabled(ctxA))
+		assert.True(t, f.Enabled(ctxB))
 	})
 }
@@ -0,0 +1,11 @@
+module github.com/jveski/coalmine/coalminegrpc
+
+go 1.16
+
+require (
+	github.com/jveski/coalmine v0.0.0
+	github.com/stretchr/testify v1.7.0
+	google.golang.org/grpc v1.43.0
+)
+
+replace github.com/jveski/coalmine => ../
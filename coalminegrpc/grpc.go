@@ -0,0 +1,68 @@
+// Package coalminegrpc integrates coalmine with gRPC servers.
+// It's a separate module to keep google.golang.org/grpc out of the core module's dependencies.
+package coalminegrpc
+
+import (
+	"context"
+
+	"github.com/jveski/coalmine"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// UnaryServerInterceptor copies the given keys from incoming metadata into coalmine values on the request's context.
+// Metadata keys are case-insensitive, matching coalmine's keys. Keys missing from the metadata are not set.
+func UnaryServerInterceptor(keys ...coalmine.Key) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(WithMetadataValues(ctx, keys...), req)
+	}
+}
+
+// StreamServerInterceptor is the streaming equivalent of UnaryServerInterceptor.
+func StreamServerInterceptor(keys ...coalmine.Key) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &serverStream{ServerStream: ss, ctx: WithMetadataValues(ss.Context(), keys...)})
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context { return s.ctx }
+
+// WithMetadataValues copies the given keys from the context's incoming metadata into coalmine values.
+// Only the first value of each key is used.
+func WithMetadataValues(ctx context.Context, keys ...coalmine.Key) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	values := map[coalmine.Key]string{}
+	for _, key := range keys {
+		if vals := md.Get(string(key)); len(vals) > 0 {
+			values[key] = vals[0]
+		}
+	}
+	if len(values) == 0 {
+		return ctx
+	}
+	return coalmine.WithValues(ctx, values)
+}
+
+// OverridesFromMetadata applies overrides read from the given key of the context's incoming metadata.
+// Values are comma-separated lists of feature names, where names prefixed with "!" are forced off
+// and all others are forced on, e.g. "featA,!featB".
+//
+// Any caller can set metadata, so only use this for servers reachable by trusted callers.
+func OverridesFromMetadata(ctx context.Context, key string) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	for _, value := range md.Get(key) {
+		ctx = coalmine.WithDecisions(ctx, value)
+	}
+	return ctx
+}
@@ -0,0 +1,76 @@
+package coalminegrpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jveski/coalmine"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+var (
+	featA = coalmine.NewFeature("coalminegrpcFeatA", coalmine.WithExactMatch("region", "west"))
+	featB = coalmine.NewFeature("coalminegrpcFeatB", coalmine.WithDefaultEnabled())
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	interceptor := UnaryServerInterceptor("region", "tenant")
+
+	t.Run("copies metadata", func(t *testing.T) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("Region", "west"))
+		var enabled bool
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			enabled = featA.Enabled(ctx)
+			return nil, nil
+		})
+		assert.NoError(t, err)
+		assert.True(t, enabled)
+	})
+
+	t.Run("no metadata", func(t *testing.T) {
+		var enabled bool
+		_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			enabled = featA.Enabled(ctx)
+			return nil, nil
+		})
+		assert.NoError(t, err)
+		assert.False(t, enabled)
+	})
+}
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (f *fakeServerStream) Context() context.Context { return f.ctx }
+
+func TestStreamServerInterceptor(t *testing.T) {
+	interceptor := StreamServerInterceptor("region")
+	ss := &fakeServerStream{ctx: metadata.NewIncomingContext(context.Background(), metadata.Pairs("region", "west"))}
+
+	var enabled bool
+	err := interceptor(nil, ss, &grpc.StreamServerInfo{}, func(srv interface{}, stream grpc.ServerStream) error {
+		enabled = featA.Enabled(stream.Context())
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, enabled)
+}
+
+func TestOverridesFromMetadata(t *testing.T) {
+	t.Run("enable and force off", func(t *testing.T) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("coalmine", "coalminegrpcFeatA,!coalminegrpcFeatB"))
+		ctx = OverridesFromMetadata(ctx, "coalmine")
+		assert.True(t, featA.Enabled(ctx))
+		assert.False(t, featB.Enabled(ctx))
+	})
+
+	t.Run("no metadata", func(t *testing.T) {
+		ctx := OverridesFromMetadata(context.Background(), "coalmine")
+		assert.False(t, featA.Enabled(ctx))
+		assert.True(t, featB.Enabled(ctx))
+	})
+}
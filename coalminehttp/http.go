@@ -0,0 +1,38 @@
+// Package coalminehttp integrates coalmine with net/http.
+package coalminehttp
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/jveski/coalmine"
+)
+
+var allowQueryOverrides int32
+
+// AllowQueryOverrides toggles OverridesFromQuery. It's disabled by default so that
+// query strings can't change feature states unless explicitly allowed, e.g. outside of production.
+func AllowQueryOverrides(allow bool) {
+	var val int32
+	if allow {
+		val = 1
+	}
+	atomic.StoreInt32(&allowQueryOverrides, val)
+}
+
+// OverridesFromQuery returns the request's context with overrides read from the given query parameter.
+// The parameter is a comma-separated list of feature names, where names prefixed with "!" are forced off
+// and all others are forced on, e.g. ?coalmine=featA,!featB. Handy for shareable debug links.
+//
+// The request's context is returned unchanged unless enabled by AllowQueryOverrides.
+func OverridesFromQuery(r *http.Request, param string) context.Context {
+	ctx := r.Context()
+	if atomic.LoadInt32(&allowQueryOverrides) != 1 {
+		return ctx
+	}
+	for _, value := range r.URL.Query()[param] {
+		ctx = coalmine.WithDecisions(ctx, value)
+	}
+	return ctx
+}
@@ -0,0 +1,52 @@
+package coalminehttp
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jveski/coalmine"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	featA = coalmine.NewFeature("coalminehttpFeatA")
+	featB = coalmine.NewFeature("coalminehttpFeatB", coalmine.WithDefaultEnabled())
+)
+
+func TestOverridesFromQuery(t *testing.T) {
+	t.Run("disallowed", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/?coalmine=coalminehttpFeatA,!coalminehttpFeatB", nil)
+		ctx := OverridesFromQuery(r, "coalmine")
+		assert.False(t, featA.Enabled(ctx))
+		assert.True(t, featB.Enabled(ctx))
+	})
+
+	AllowQueryOverrides(true)
+	defer AllowQueryOverrides(false)
+
+	t.Run("enable and force off", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/?coalmine=coalminehttpFeatA,!coalminehttpFeatB", nil)
+		ctx := OverridesFromQuery(r, "coalmine")
+		assert.True(t, featA.Enabled(ctx))
+		assert.False(t, featB.Enabled(ctx))
+	})
+
+	t.Run("repeated param and casing", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/?coalmine=COALMINEHTTPFEATA&coalmine=!coalminehttpfeatb", nil)
+		ctx := OverridesFromQuery(r, "coalmine")
+		assert.True(t, featA.Enabled(ctx))
+		assert.False(t, featB.Enabled(ctx))
+	})
+
+	t.Run("other param", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/?features=coalminehttpFeatA", nil)
+		ctx := OverridesFromQuery(r, "coalmine")
+		assert.False(t, featA.Enabled(ctx))
+	})
+
+	t.Run("empty tokens", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/?coalmine=,!,coalminehttpFeatA", nil)
+		ctx := OverridesFromQuery(r, "coalmine")
+		assert.True(t, featA.Enabled(ctx))
+	})
+}
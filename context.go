@@ -1,8 +1,14 @@
 package coalmine
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type featureKey string
@@ -14,14 +20,46 @@ func WithOverride(ctx context.Context, feature *Feature, enable bool) context.Co
 	return context.WithValue(ctx, newFeatureKey(feature.name), enable)
 }
 
-func getOverride(ctx context.Context, feature string) (bool /* state */, bool /* present */) {
-	val := ctx.Value(newFeatureKey(feature))
+// getOverride looks up an override by its featureKey, which is passed as an interface to avoid boxing it on every call.
+func getOverride(ctx context.Context, key interface{}) (bool /* state */, bool /* present */) {
+	val := ctx.Value(key)
 	if val == nil {
 		return false, false
 	}
 	return val.(bool), true
 }
 
+type prefixOverridesKey struct{}
+
+type prefixOverride struct {
+	prefix string // lowercased
+	enable bool
+}
+
+// WithOverridePrefix forces every feature whose (case-insensitive) name starts with prefix to be either enabled
+// or disabled, e.g. "payments." for all payments features. Useful for testing whole subsystems.
+// Overrides of a specific feature take precedence over prefix overrides, and later prefix overrides take precedence over earlier ones.
+func WithOverridePrefix(ctx context.Context, prefix string, enable bool) context.Context {
+	prev := getPrefixOverrides(ctx)
+	overrides := make([]prefixOverride, 0, len(prev)+1)
+	overrides = append(overrides, prefixOverride{prefix: strings.ToLower(prefix), enable: enable})
+	overrides = append(overrides, prev...)
+	return context.WithValue(ctx, prefixOverridesKey{}, overrides)
+}
+
+func getPrefixOverrides(ctx context.Context) []prefixOverride {
+	val := ctx.Value(prefixOverridesKey{})
+	if val == nil {
+		return nil
+	}
+	return val.([]prefixOverride)
+}
+
+// WithOverrideName is identical to WithOverride except the feature is referenced by its (case-insensitive) name.
+func WithOverrideName(ctx context.Context, name string, enable bool) context.Context {
+	return context.WithValue(ctx, newFeatureKey(name), enable)
+}
+
 // WithOverrideString forces a list of feature to be enabled. Specified as a comma-separated
 // string and optional prefix to be removed from each item.
 func WithOverrideString(ctx context.Context, prfx, str string) context.Context {
@@ -32,21 +70,325 @@ func WithOverrideString(ctx context.Context, prfx, str string) context.Context {
 	return ctx
 }
 
+// EncodeDecisions evaluates the given features and encodes their states for propagation to other services
+// (i.e. in a request header), where they can be applied using WithDecisions so downstream services don't
+// re-evaluate and possibly diverge. The encoding is a comma-separated list of feature names with disabled
+// features prefixed by "!", e.g. "featA,!featB". WithDryRun is ignored so that dry runs propagate the states
+// features would have had rather than disabling every feature downstream.
+// Panics if a feature's name contains a comma or starts with "!", since it can't be decoded.
+func EncodeDecisions(ctx context.Context, features ...*Feature) string {
+	var b strings.Builder
+	for i, f := range features {
+		if strings.Contains(f.name, ",") || strings.HasPrefix(f.name, "!") {
+			panic(fmt.Errorf("coalmine feature name %q can't be encoded since it contains a comma or starts with \"!\"", f.name))
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if !f.decide(ctx, false).State {
+			b.WriteByte('!')
+		}
+		b.WriteString(f.name)
+	}
+	return b.String()
+}
+
+// WithDecisions applies states encoded by EncodeDecisions as overrides. Empty items and names that don't belong
+// to a feature (or one of its aliases) are ignored.
+func WithDecisions(ctx context.Context, encoded string) context.Context {
+	for _, chunk := range strings.Split(encoded, ",") {
+		name := strings.TrimSpace(chunk)
+		enable := !strings.HasPrefix(name, "!")
+		name = strings.TrimPrefix(name, "!")
+		if name == "" || lookupFeature(name) == nil {
+			continue
+		}
+		ctx = WithOverrideName(ctx, name, enable)
+	}
+	return ctx
+}
+
+// WithOverrideFile applies overrides read from a file containing lines of the form "feature=true"
+// or "feature=false" ("on" and "off" are also accepted). Anything following a "#" is a comment, e.g. "checkout=off # INC-1234".
+// Malformed lines are skipped and a missing file is not an error.
+// Intended for local development (i.e. a .coalmine-overrides file read at startup).
+func WithOverrideFile(ctx context.Context, path string) (context.Context, error) {
+	overrides, _, err := readOverrideFile(path)
+	if err != nil {
+		return ctx, err
+	}
+	for key, enable := range overrides {
+		ctx = context.WithValue(ctx, key, enable)
+	}
+	return ctx, nil
+}
+
+// readOverrideFile parses an override file, returning the overrides and the trailing comment of each override line (if any).
+// A missing file results in empty maps.
+func readOverrideFile(path string) (map[featureKey]bool, map[featureKey]string, error) {
+	overrides, notes := map[featureKey]bool{}, map[featureKey]string{}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return overrides, notes, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, note := scanner.Text(), ""
+		if i := strings.Index(line, "#"); i >= 0 {
+			line, note = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		chunks := strings.SplitN(line, "=", 2)
+		if len(chunks) != 2 {
+			continue
+		}
+		name := strings.TrimSpace(chunks[0])
+		enable, err := parseOverrideState(strings.TrimSpace(chunks[1]))
+		if name == "" || err != nil {
+			continue
+		}
+		overrides[newFeatureKey(name)] = enable
+		if note != "" {
+			notes[newFeatureKey(name)] = note
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return overrides, notes, nil
+}
+
+func parseOverrideState(str string) (bool, error) {
+	switch strings.ToLower(str) {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	default:
+		return strconv.ParseBool(str)
+	}
+}
+
 type valueKey string
 
 func newValueKey(key Key) valueKey { return valueKey(strings.ToLower(string(key))) }
 
 // WithValue adds a string kv pair to the context for use with matchers. Keys are case-insensitive.
 func WithValue(ctx context.Context, key Key, value string) context.Context {
-	return context.WithValue(ctx, newValueKey(key), value)
+	return &valueContext{Context: ctx, key: newValueKey(key), value: value}
+}
+
+type valueMetaKey string
+
+type valueMeta struct {
+	value string
+	meta  map[string]string
+}
+
+// WithValueMeta is identical to WithValue except metadata describing the value (i.e. where it came from) is attached for diagnostics.
+// Metadata doesn't affect matching. It can be read back by ValueMeta, i.e. from an observer.
+func WithValueMeta(ctx context.Context, key Key, value string, meta map[string]string) context.Context {
+	ctx = WithValue(ctx, key, value)
+	return context.WithValue(ctx, valueMetaKey(newValueKey(key)), &valueMeta{value: value, meta: meta})
+}
+
+// ValueMeta returns the metadata attached to the key's current value by WithValueMeta, if any.
+// Metadata is dropped once the value is replaced by a later call to WithValue.
+func ValueMeta(ctx context.Context, key Key) map[string]string {
+	val := ctx.Value(valueMetaKey(newValueKey(key)))
+	if val == nil {
+		return nil
+	}
+	vm := val.(*valueMeta)
+	if current, _ := ctx.Value(newValueKey(key)).(string); current != vm.value {
+		return nil
+	}
+	return vm.meta
+}
+
+// valuesLayerKey resolves to the closest valueContext or valuesContext, so values can be enumerated by walking the layers.
+type valuesLayerKey struct{}
+
+// valueContext is equivalent to context.WithValue, but can be enumerated by values.
+type valueContext struct {
+	context.Context
+	key   valueKey
+	value interface{} // boxed once rather than on every lookup
+}
+
+func (v *valueContext) Value(key interface{}) interface{} {
+	switch k := key.(type) {
+	case valueKey:
+		if k == v.key {
+			return v.value
+		}
+	case valuesLayerKey:
+		return v
+	}
+	return v.Context.Value(key)
+}
+
+type valuesContext struct {
+	context.Context
+	values map[valueKey]string
+}
+
+func (v *valuesContext) Value(key interface{}) interface{} {
+	switch k := key.(type) {
+	case valueKey:
+		if val, ok := v.values[k]; ok {
+			return val
+		}
+	case valuesLayerKey:
+		return v
+	}
+	return v.Context.Value(key)
+}
+
+// WithValues adds several string kv pairs to the context at once. Equivalent to calling WithValue for each pair,
+// but the values share a single layer of the context chain to keep lookups cheap.
+func WithValues(ctx context.Context, kv map[Key]string) context.Context {
+	values := make(map[valueKey]string, len(kv))
+	for key, value := range kv {
+		values[newValueKey(key)] = value
+	}
+	return &valuesContext{Context: ctx, values: values}
+}
+
+// values returns every string value set on the context by WithValue or WithValues, keyed by lowercased key.
+// Values from a ValueProvider aren't included since providers can't be enumerated.
+func values(ctx context.Context) map[valueKey]string {
+	all := map[valueKey]string{}
+	add := func(k valueKey, v string) {
+		if _, ok := all[k]; !ok {
+			all[k] = v // inner layers shadow outer ones
+		}
+	}
+	for layer := ctx.Value(valuesLayerKey{}); layer != nil; {
+		switch l := layer.(type) {
+		case *valueContext:
+			add(l.key, l.value.(string))
+			layer = l.Context.Value(valuesLayerKey{})
+		case *valuesContext:
+			for k, v := range l.values {
+				add(k, v)
+			}
+			layer = l.Context.Value(valuesLayerKey{})
+		}
+	}
+	return all
+}
+
+// MergeValues copies the values set on src by WithValue or WithValues onto dst. Values already present on dst win
+// when both contexts set the same key. Only string values are merged: bool/slice values, metadata, and values served
+// by a ValueProvider are not copied.
+func MergeValues(dst, src context.Context) context.Context {
+	merged := map[valueKey]string{}
+	for k, v := range values(src) {
+		if dst.Value(k) == nil {
+			merged[k] = v
+		}
+	}
+	if len(merged) == 0 {
+		return dst
+	}
+	return &valuesContext{Context: dst, values: merged}
+}
+
+// Capture returns the values of the given keys, for replaying evaluations later with WithCaptured (i.e. offline analysis).
+// Keys that haven't been set are omitted. Values are captured after normalization by WithValueNormalizer.
+func Capture(ctx context.Context, keys ...Key) map[Key]string {
+	captured := make(map[Key]string, len(keys))
+	for _, key := range keys {
+		if val, present := lookupValue(ctx, key); present {
+			captured[key] = val
+		}
+	}
+	return captured
+}
+
+// WithCaptured restores values returned by Capture.
+func WithCaptured(ctx context.Context, captured map[Key]string) context.Context {
+	return WithValues(ctx, captured)
 }
 
 func getValue(ctx context.Context, key Key) string {
+	val, present := lookupValue(ctx, key)
+	if !present {
+		trackMissing(ctx, key)
+	}
+	return val
+}
+
+// trackMissing reports a key that a matcher examined but hasn't been set to the context's key tracker (see EnabledStrict), if any.
+func trackMissing(ctx context.Context, key Key) {
+	if tracker := getKeyTracker(ctx); tracker != nil {
+		tracker.add(key)
+	}
+}
+
+func lookupValue(ctx context.Context, key Key) (string /* value */, bool /* present */) {
 	val := ctx.Value(newValueKey(key))
 	if val == nil {
-		return ""
+		provider := getValueProvider(ctx)
+		if provider == nil {
+			return "", false
+		}
+		str, ok := provider.Value(key)
+		if !ok {
+			return "", false
+		}
+		val = str
 	}
-	return val.(string)
+	if normalizer := getValueNormalizer(ctx); normalizer != nil {
+		return normalizer(val.(string)), true
+	}
+	return val.(string), true
+}
+
+// ValueProvider supplies values for keys that haven't been set on the context by WithValue.
+type ValueProvider interface {
+	// Value returns the value of the key and whether it's present. Keys may be in any casing.
+	Value(key Key) (string, bool)
+}
+
+type valueProviderKey struct{}
+
+// WithValueProvider consults p for keys that haven't been set on the context, allowing values to be
+// read from existing request structs or computed lazily rather than copied into the context up front.
+// Values set by WithValue take precedence.
+func WithValueProvider(ctx context.Context, p ValueProvider) context.Context {
+	return context.WithValue(ctx, valueProviderKey{}, p)
+}
+
+func getValueProvider(ctx context.Context) ValueProvider {
+	val := ctx.Value(valueProviderKey{})
+	if val == nil {
+		return nil
+	}
+	return val.(ValueProvider)
+}
+
+type valueNormalizerKey struct{}
+
+// WithValueNormalizer applies fn to every context value before it's seen by matchers.
+// Useful when upstream systems are inconsistent, e.g. strings.ToLower for values that are sometimes uppercased.
+//
+// Normalization also applies to percentage-based matchers, so changing the normalizer can move values between cohorts.
+func WithValueNormalizer(ctx context.Context, fn func(string) string) context.Context {
+	return context.WithValue(ctx, valueNormalizerKey{}, fn)
+}
+
+func getValueNormalizer(ctx context.Context) func(string) string {
+	val := ctx.Value(valueNormalizerKey{})
+	if val == nil {
+		return nil
+	}
+	return val.(func(string) string)
 }
 
 type observerKey struct{}
@@ -54,11 +396,41 @@ type observerKey struct{}
 type ObserverFunc func(ctx context.Context, feature string, state bool)
 
 // WithObserver registers a function to be called every time a feature is evaluated by feature.Enabled.
-// Useful for logging feature states.
+// Useful for logging feature states. Replaces any observers previously registered on the context.
 func WithObserver(ctx context.Context, fn ObserverFunc) context.Context {
 	return context.WithValue(ctx, observerKey{}, fn)
 }
 
+// WithObserverChain is identical to WithObserver except the given functions are called in addition to
+// (and after) any observers previously registered on the context.
+// A panicking observer doesn't prevent the rest of the chain from being called.
+func WithObserverChain(ctx context.Context, fns ...ObserverFunc) context.Context {
+	if prev := getObserver(ctx); prev != nil {
+		fns = append([]ObserverFunc{prev}, fns...)
+	}
+	return WithObserver(ctx, func(ctx context.Context, feature string, state bool) {
+		for _, fn := range fns {
+			callObserver(ctx, fn, feature, state)
+		}
+	})
+}
+
+// callObserver calls a single observer of a chain, recovering from any panics like Feature.observe.
+func callObserver(ctx context.Context, fn ObserverFunc, feature string, state bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			observerPanicMetric.WithLabelValues(feature).Inc()
+		}
+	}()
+	fn(ctx, feature, state)
+}
+
+// WithoutObserver suppresses any observers registered on the context for evaluations using the returned context.
+// Useful for speculative evaluations (i.e. feature.Preview) that shouldn't be logged.
+func WithoutObserver(ctx context.Context) context.Context {
+	return context.WithValue(ctx, observerKey{}, ObserverFunc(nil))
+}
+
 func getObserver(ctx context.Context) ObserverFunc {
 	val := ctx.Value(observerKey{})
 	if val == nil {
@@ -66,3 +438,256 @@ func getObserver(ctx context.Context) ObserverFunc {
 	}
 	return val.(ObserverFunc)
 }
+
+type metricsHookKey struct{}
+
+// MetricsHookFunc receives the outcome of every feature evaluation along with the reason for it.
+type MetricsHookFunc func(feature string, enabled bool, reason Reason)
+
+// WithMetricsHook registers a function to be called every time a feature is evaluated by feature.Enabled.
+// Unlike observers, the hook receives the reason for each decision, making it suitable for emitting
+// metrics to systems other than Prometheus.
+func WithMetricsHook(ctx context.Context, fn MetricsHookFunc) context.Context {
+	return context.WithValue(ctx, metricsHookKey{}, fn)
+}
+
+func getMetricsHook(ctx context.Context) MetricsHookFunc {
+	val := ctx.Value(metricsHookKey{})
+	if val == nil {
+		return nil
+	}
+	return val.(MetricsHookFunc)
+}
+
+type evaluationCacheKey struct{}
+
+type evaluationCache struct {
+	mut     sync.Mutex
+	results map[*Feature]int
+}
+
+func (e *evaluationCache) load(f *Feature) (int /* matcher index */, bool /* present */) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	i, present := e.results[f]
+	return i, present
+}
+
+func (e *evaluationCache) store(f *Feature, i int) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.results[f] = i
+}
+
+// WithEvaluationCache memoizes the result of each feature's matchers for the lifetime of the returned context.
+// Useful when a feature is checked several times while handling a single request.
+//
+// Only matcher results are cached: overrides are still honored and observers are still called on every evaluation.
+// Values added to derived contexts after the cache is installed will not be reflected in cached results.
+func WithEvaluationCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, evaluationCacheKey{}, &evaluationCache{results: map[*Feature]int{}})
+}
+
+func getEvaluationCache(ctx context.Context) *evaluationCache {
+	val := ctx.Value(evaluationCacheKey{})
+	if val == nil {
+		return nil
+	}
+	return val.(*evaluationCache)
+}
+
+type evaluationTimeoutKey struct{}
+
+// WithEvaluationTimeout bounds the time spent evaluating each feature's matchers, i.e. when custom matchers call
+// slow external systems. Matchers that exceed the timeout are treated as not matching and counted by the
+// coalmine_feature_timeout_total metric. They run on a separate goroutine, which keeps running after a timeout.
+func WithEvaluationTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, evaluationTimeoutKey{}, d)
+}
+
+func getEvaluationTimeout(ctx context.Context) time.Duration {
+	val := ctx.Value(evaluationTimeoutKey{})
+	if val == nil {
+		return 0
+	}
+	return val.(time.Duration)
+}
+
+type decisionSinkKey struct{}
+
+// WithDecisionSink causes feature.Enabled to record the details of each evaluation into the given Decision.
+// The caller owns the Decision and should not share it between goroutines.
+func WithDecisionSink(ctx context.Context, d *Decision) context.Context {
+	return context.WithValue(ctx, decisionSinkKey{}, d)
+}
+
+func getDecisionSink(ctx context.Context) *Decision {
+	val := ctx.Value(decisionSinkKey{})
+	if val == nil {
+		return nil
+	}
+	return val.(*Decision)
+}
+
+type bytesValueKey string
+
+// WithBytesValue adds a binary kv pair to the context for use with WithPercentageBytes. Keys are case-insensitive.
+// Byte values are kept separate from string values set by WithValue, even when they share a key.
+func WithBytesValue(ctx context.Context, key Key, value []byte) context.Context {
+	return context.WithValue(ctx, bytesValueKey(newValueKey(key)), value)
+}
+
+func getBytesValue(ctx context.Context, key Key) []byte {
+	val := ctx.Value(bytesValueKey(newValueKey(key)))
+	if val == nil {
+		trackMissing(ctx, key)
+		return nil
+	}
+	return val.([]byte)
+}
+
+type sliceValueKey string
+
+// WithSliceValue adds a multi-valued kv pair (i.e. a user's roles) to the context for use with WithSliceContains.
+// Keys are case-insensitive. Slice values are kept separate from string values set by WithValue, even when they share a key.
+func WithSliceValue(ctx context.Context, key Key, values []string) context.Context {
+	return context.WithValue(ctx, sliceValueKey(newValueKey(key)), append([]string(nil), values...))
+}
+
+func getSliceValue(ctx context.Context, key Key) []string {
+	val := ctx.Value(sliceValueKey(newValueKey(key)))
+	if val == nil {
+		trackMissing(ctx, key)
+		return nil
+	}
+	return val.([]string)
+}
+
+type boolValueKey string
+
+// WithBoolValue adds a boolean kv pair to the context for use with WithBoolTrue and WithBoolFalse. Keys are case-insensitive.
+// Boolean values are kept separate from string values set by WithValue, even when they share a key.
+func WithBoolValue(ctx context.Context, key Key, value bool) context.Context {
+	return context.WithValue(ctx, boolValueKey(newValueKey(key)), value)
+}
+
+func getBoolValue(ctx context.Context, key Key) bool {
+	val := ctx.Value(boolValueKey(newValueKey(key)))
+	if val == nil {
+		trackMissing(ctx, key)
+		return false
+	}
+	return val.(bool)
+}
+
+type saltKey struct{}
+
+// WithSalt mixes salt into the hash used by percentage-based matchers evaluated using the returned context.
+// Useful for giving each tenant of a multi-tenant service independent rollout cohorts from the same matchers.
+func WithSalt(ctx context.Context, salt string) context.Context {
+	return context.WithValue(ctx, saltKey{}, salt)
+}
+
+func getSalt(ctx context.Context) string {
+	val := ctx.Value(saltKey{})
+	if val == nil {
+		return ""
+	}
+	return val.(string)
+}
+
+type releaseLevelKey struct{}
+
+// WithReleaseLevel sets the current release level for use with WithLeveledPercentage.
+func WithReleaseLevel(ctx context.Context, level int64) context.Context {
+	return context.WithValue(ctx, releaseLevelKey{}, level)
+}
+
+func getReleaseLevel(ctx context.Context) (int64 /* level */, bool /* present */) {
+	val := ctx.Value(releaseLevelKey{})
+	if val == nil {
+		return 0, false
+	}
+	return val.(int64), true
+}
+
+type detailKey struct{}
+
+// setDetail records an explanation of a matcher's result in the current Decision, if one is being collected.
+func setDetail(ctx context.Context, format string, args ...interface{}) {
+	val := ctx.Value(detailKey{})
+	if val == nil {
+		return
+	}
+	*val.(*string) = fmt.Sprintf(format, args...)
+}
+
+type strictKeysKey struct{}
+
+// StrictKeysFunc is called when a feature's matchers examine keys that haven't been set on the context.
+type StrictKeysFunc func(feature string, missing []Key)
+
+// WithStrictKeys registers a function to be called by feature.Enabled when matchers examine keys that
+// haven't been set on the context. Useful for detecting request pipelines that forgot to call WithValue.
+// Only keys that were actually examined are reported, so keys skipped by short-circuiting are not.
+func WithStrictKeys(ctx context.Context, fn StrictKeysFunc) context.Context {
+	return context.WithValue(ctx, strictKeysKey{}, fn)
+}
+
+func getStrictKeysFunc(ctx context.Context) StrictKeysFunc {
+	val := ctx.Value(strictKeysKey{})
+	if val == nil {
+		return nil
+	}
+	return val.(StrictKeysFunc)
+}
+
+type keyTrackerKey struct{}
+
+// keyTracker collects the missing keys examined during a single evaluation.
+type keyTracker struct {
+	missing []Key
+}
+
+func (k *keyTracker) add(key Key) {
+	for _, existing := range k.missing {
+		if newValueKey(existing) == newValueKey(key) {
+			return
+		}
+	}
+	k.missing = append(k.missing, key)
+}
+
+func getKeyTracker(ctx context.Context) *keyTracker {
+	val := ctx.Value(keyTrackerKey{})
+	if val == nil {
+		return nil
+	}
+	return val.(*keyTracker)
+}
+
+type dryRunKey struct{}
+
+// WithDryRun causes feature.Enabled to always return false while still evaluating features as usual.
+// Observers, metrics, and decision sinks report the state the feature would have had.
+// Useful for validating which requests a feature would be enabled for before actually enabling it.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+func isDryRun(ctx context.Context) bool {
+	val := ctx.Value(dryRunKey{})
+	return val != nil && val.(bool)
+}
+
+type probeKey struct{}
+
+// withProbe marks evaluations made by Feature.Probe, which must not have side effects.
+func withProbe(ctx context.Context) context.Context {
+	return context.WithValue(ctx, probeKey{}, true)
+}
+
+func isProbe(ctx context.Context) bool {
+	val := ctx.Value(probeKey{})
+	return val != nil && val.(bool)
+}
@@ -0,0 +1,48 @@
+package coalmine
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	expvarMap  atomic.Value // *expvar.Map once PublishExpvar has been called
+	expvarOnce sync.Once
+)
+
+type featureVars struct {
+	Enables        uint64 `json:"enables"`
+	Disabled       bool   `json:"disabled"`
+	GlobalOverride *bool  `json:"global_override"`
+}
+
+// PublishExpvar exposes every feature as an expvar.Map named "coalmine", for tooling that reads expvar rather than
+// Prometheus. Each feature's entry holds the number of times it has been enabled by a matcher or override, whether it
+// was disabled by WithDisabled, and its global override (null when unset). Features allocated later are included as well.
+// Nothing is published until PublishExpvar is called. Subsequent calls have no effect.
+func PublishExpvar() {
+	expvarOnce.Do(func() {
+		m := expvar.NewMap("coalmine")
+		expvarMap.Store(m)
+		registry.Range(func(key, value interface{}) bool {
+			value.(*Feature).publishExpvar()
+			return true
+		})
+	})
+}
+
+func (f *Feature) publishExpvar() {
+	m, ok := expvarMap.Load().(*expvar.Map)
+	if !ok {
+		return
+	}
+	m.Set(f.name, expvar.Func(func() interface{} {
+		vars := featureVars{Enables: atomic.LoadUint64(&f.enables), Disabled: f.disabled}
+		if val, present := globalOverrides.Load(f); present {
+			enabled := val.(bool)
+			vars.GlobalOverride = &enabled
+		}
+		return vars
+	}))
+}
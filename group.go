@@ -0,0 +1,30 @@
+package coalmine
+
+// Group is a set of matchers shared as a prerequisite by several features, e.g. "internal users only".
+type Group struct {
+	name string
+	opts []MatcherOption
+}
+
+// NewGroup allocates a new Group using the provided matcher options.
+// Like features, the group's prerequisite is met when any of its matchers match.
+// A group without matchers imposes no prerequisite.
+func NewGroup(name string, opts ...MatcherOption) *Group {
+	return &Group{name: name, opts: opts}
+}
+
+// NewFeature allocates a new Feature that is only enabled when the group's prerequisite is met
+// and one of its own matchers match. Overrides still take precedence over the group.
+func (g *Group) NewFeature(name string, opts ...MatcherOption) *Feature {
+	return NewFeature(name, append([]MatcherOption{g.gateOption()}, opts...)...)
+}
+
+func (g *Group) gateOption() MatcherOption {
+	return func(f *Feature) *matcher {
+		if len(g.opts) == 0 {
+			return nil
+		}
+		f.addGate(WithOR(g.opts...)(f))
+		return nil
+	}
+}
@@ -2,21 +2,86 @@ package coalmine
 
 import (
 	"context"
-	"hash/fnv"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // MatcherOption configures matchers: logical operations against context values set by WithValue.
 type MatcherOption func(*Feature) *matcher
 
 type matcher struct {
+	op       matcherOp // how child matchers are combined
+	n        int       // minimum number of matching children for opAtLeastN
 	matchers []*matcher
 	fn       func(context.Context) bool
+	featFn   func(ctx context.Context, feature string) bool // alternative to fn for matchers that depend on the owning feature's name
+	keys     []Key                                          // context keys referenced by fn or featFn
+	kind     string                                         // describes fn or featFn for introspection, e.g. "exact_match"
+	args     []interface{}                                  // arguments of the matcher's constructor for introspection
+
+	feature string // name of the feature that owns the matcher
+	index   string // position in the feature's matcher tree, e.g. "1.0"
 }
 
 func (m *matcher) evaluate(ctx context.Context) bool {
+	ok := m.evaluateInner(ctx)
+	if getFlag(&matcherMetricEnabled) && !isProbe(ctx) {
+		matcherMetric.WithLabelValues(m.feature, m.index, strconv.FormatBool(ok)).Inc()
+	}
+	return ok
+}
+
+func (m *matcher) evaluateInner(ctx context.Context) bool {
 	if m.fn != nil {
 		return m.fn(ctx)
 	}
+	if m.featFn != nil {
+		return m.featFn(ctx, m.feature)
+	}
+	switch m.op {
+	case opOR:
+		for _, child := range m.matchers {
+			if child.evaluate(ctx) {
+				return true
+			}
+		}
+		return false
+	case opNOT:
+		return !m.evaluateAND(ctx)
+	case opAtLeastN:
+		count := 0
+		for _, child := range m.matchers {
+			if child.evaluate(ctx) {
+				count++
+			}
+			if count >= m.n {
+				return true
+			}
+		}
+		return false
+	case opXOR:
+		count := 0
+		for _, child := range m.matchers {
+			if child.evaluate(ctx) {
+				count++
+			}
+			if count > 1 {
+				return false
+			}
+		}
+		return count == 1
+	default:
+		return m.evaluateAND(ctx)
+	}
+}
+
+func (m *matcher) evaluateAND(ctx context.Context) bool {
 	for _, child := range m.matchers {
 		if !child.evaluate(ctx) {
 			return false
@@ -25,15 +90,154 @@ func (m *matcher) evaluate(ctx context.Context) bool {
 	return true
 }
 
+func (m *matcher) setIndex(feature, index string) {
+	m.feature, m.index = feature, index
+	for i, child := range m.matchers {
+		child.setIndex(feature, index+"."+strconv.Itoa(i))
+	}
+}
+
+// clone returns a deep copy of the matcher tree. Functions are shared since they don't hold per-feature state.
+func (m *matcher) clone() *matcher {
+	c := *m
+	if m.matchers != nil {
+		c.matchers = make([]*matcher, len(m.matchers))
+		for i, child := range m.matchers {
+			c.matchers[i] = child.clone()
+		}
+	}
+	return &c
+}
+
+// matcherInfo is the JSON representation of a matcher tree. See Registry.
+type matcherInfo struct {
+	Kind     string         `json:"kind"`
+	Keys     []Key          `json:"keys,omitempty"`
+	Args     []interface{}  `json:"args,omitempty"`
+	Matchers []*matcherInfo `json:"matchers,omitempty"`
+}
+
+func (m *matcher) describe() *matcherInfo {
+	info := &matcherInfo{Kind: m.kind, Keys: m.keys, Args: m.args}
+	if info.Kind == "" {
+		info.Kind = m.op.String()
+	}
+	if m.op == opAtLeastN {
+		info.Args = []interface{}{m.n}
+	}
+	for _, child := range m.matchers {
+		info.Matchers = append(info.Matchers, child.describe())
+	}
+	return info
+}
+
+func (m *matcher) appendKeys(keys []Key, seen map[valueKey]struct{}) []Key {
+	for _, key := range m.keys {
+		if _, ok := seen[newValueKey(key)]; ok {
+			continue
+		}
+		seen[newValueKey(key)] = struct{}{}
+		keys = append(keys, key)
+	}
+	for _, child := range m.matchers {
+		keys = child.appendKeys(keys, seen)
+	}
+	return keys
+}
+
+type matcherOp int
+
+const (
+	opAND matcherOp = iota
+	opOR
+	opNOT
+	opAtLeastN
+	opXOR
+)
+
+func (o matcherOp) String() string {
+	switch o {
+	case opOR:
+		return "or"
+	case opNOT:
+		return "not"
+	case opAtLeastN:
+		return "at_least_n"
+	case opXOR:
+		return "xor"
+	default:
+		return "and"
+	}
+}
+
 // WithAND enables a feature when all child matchers are positively matched.
+// Like the other combinators, options that don't produce a matcher (i.e. WithAlias) are ignored.
 func WithAND(opts ...MatcherOption) MatcherOption {
 	return func(f *Feature) *matcher {
 		m := &matcher{}
-		m.matchers = make([]*matcher, len(opts))
-		for i, opt := range opts {
-			child := opt(f)
-			if child != nil {
-				m.matchers[i] = child
+		for _, opt := range opts {
+			if child := opt(f); child != nil {
+				m.matchers = append(m.matchers, child)
+			}
+		}
+		return m
+	}
+}
+
+// WithOR enables a feature when any child matcher is positively matched.
+// Equivalent to passing each matcher to NewFeature, but can be nested within other matchers.
+func WithOR(opts ...MatcherOption) MatcherOption {
+	return func(f *Feature) *matcher {
+		m := &matcher{op: opOR}
+		for _, opt := range opts {
+			if child := opt(f); child != nil {
+				m.matchers = append(m.matchers, child)
+			}
+		}
+		return m
+	}
+}
+
+// WithNOT enables a feature when the child matcher is not positively matched.
+func WithNOT(opt MatcherOption) MatcherOption {
+	return func(f *Feature) *matcher {
+		m := &matcher{op: opNOT}
+		if child := opt(f); child != nil {
+			m.matchers = append(m.matchers, child)
+		}
+		return m
+	}
+}
+
+// WithAtLeastN enables a feature when at least n of the child matchers are positively matched.
+// Panics unless 0 < n <= len(opts). Options that don't produce a matcher (i.e. WithAlias) aren't children,
+// so the feature's allocation panics if fewer than n of them remain.
+func WithAtLeastN(n int, opts ...MatcherOption) MatcherOption {
+	if n <= 0 || n > len(opts) {
+		panic(fmt.Errorf("coalmine WithAtLeastN requires 0 < n <= %d, got %d", len(opts), n))
+	}
+	return func(f *Feature) *matcher {
+		m := &matcher{op: opAtLeastN, n: n}
+		for _, opt := range opts {
+			if child := opt(f); child != nil {
+				m.matchers = append(m.matchers, child)
+			}
+		}
+		if n > len(m.matchers) {
+			panic(fmt.Errorf("coalmine WithAtLeastN requires 0 < n <= %d matchers, got %d", len(m.matchers), n))
+		}
+		return m
+	}
+}
+
+// WithXOR enables a feature when exactly one of the child matchers is positively matched.
+// Note this differs from chaining binary XORs, which would also match when three children match.
+func WithXOR(opts ...MatcherOption) MatcherOption {
+	return func(f *Feature) *matcher {
+		m := &matcher{op: opXOR}
+		for _, opt := range opts {
+			if child := opt(f); child != nil {
+				m.matchers = append(m.matchers, child)
 			}
 		}
 		return m
@@ -44,7 +248,7 @@ func WithAND(opts ...MatcherOption) MatcherOption {
 // against the corresponding context value.
 func WithExactMatch(key Key, value string) MatcherOption {
 	return func(f *Feature) *matcher {
-		m := &matcher{}
+		m := &matcher{kind: "exact_match", args: []interface{}{value}, keys: []Key{key}}
 		m.fn = func(ctx context.Context) bool {
 			return getValue(ctx, key) == value
 		}
@@ -52,16 +256,675 @@ func WithExactMatch(key Key, value string) MatcherOption {
 	}
 }
 
+// WithExactMatchFold is identical to WithExactMatch except values are compared case-insensitively.
+func WithExactMatchFold(key Key, value string) MatcherOption {
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "exact_match_fold", args: []interface{}{value}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			return strings.EqualFold(getValue(ctx, key), value)
+		}
+		return m
+	}
+}
+
+// WithExactMatchAny enables a feature when any of the given context values is equal to value.
+func WithExactMatchAny(value string, keys ...Key) MatcherOption {
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "exact_match_any", args: []interface{}{value}, keys: keys}
+		m.fn = func(ctx context.Context) bool {
+			for _, key := range keys {
+				if getValue(ctx, key) == value {
+					return true
+				}
+			}
+			return false
+		}
+		return m
+	}
+}
+
+// WithValueOneOf enables a feature when the context value is set and equal to one of the given values.
+// When the feature is evaluated with a decision sink (see WithDecisionSink), misses are explained in
+// Decision.Detail, distinguishing values that weren't set from values that didn't match.
+func WithValueOneOf(key Key, values ...string) MatcherOption {
+	set := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		set[value] = struct{}{}
+	}
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "value_one_of", args: []interface{}{values}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			value, present := lookupValue(ctx, key)
+			if !present {
+				trackMissing(ctx, key)
+				setDetail(ctx, "key %q is not set", key)
+				return false
+			}
+			if _, ok := set[value]; !ok {
+				setDetail(ctx, "value %q of key %q is not one of the expected values", value, key)
+				return false
+			}
+			return true
+		}
+		return m
+	}
+}
+
+// WithListContains enables a feature when target is an item of the context value, which is
+// treated as a list delimited by sep. Items are trimmed of surrounding whitespace.
+func WithListContains(key Key, target string, sep string) MatcherOption {
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "list_contains", args: []interface{}{target, sep}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			value := getValue(ctx, key)
+			if value == "" {
+				return false
+			}
+			for _, item := range strings.Split(value, sep) {
+				if strings.TrimSpace(item) == target {
+					return true
+				}
+			}
+			return false
+		}
+		return m
+	}
+}
+
+// WithSliceContains enables a feature when the slice value set by WithSliceValue contains the target.
+func WithSliceContains(key Key, target string) MatcherOption {
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "slice_contains", args: []interface{}{target}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			for _, value := range getSliceValue(ctx, key) {
+				if value == target {
+					return true
+				}
+			}
+			return false
+		}
+		return m
+	}
+}
+
+// WithValueFunc enables a feature when fn returns true for the given context value.
+// fn receives an empty string when the value isn't set.
+func WithValueFunc(key Key, fn func(string) bool) MatcherOption {
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "value_func", keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			return fn(getValue(ctx, key))
+		}
+		return m
+	}
+}
+
+// WithKeyPresent enables a feature when a value has been set for the given key, even if it's empty.
+func WithKeyPresent(key Key) MatcherOption {
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "key_present", keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			_, present := lookupValue(ctx, key)
+			return present
+		}
+		return m
+	}
+}
+
+// WithKeyAbsent enables a feature when no value has been set for the given key.
+func WithKeyAbsent(key Key) MatcherOption {
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "key_absent", keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			_, present := lookupValue(ctx, key)
+			return !present
+		}
+		return m
+	}
+}
+
+// WithBoolTrue matches when the boolean value set by WithBoolValue is true.
+func WithBoolTrue(key Key) MatcherOption {
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "bool_true", keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			return getBoolValue(ctx, key)
+		}
+		return m
+	}
+}
+
+// WithBoolFalse matches when the boolean value set by WithBoolValue is false or hasn't been set.
+func WithBoolFalse(key Key) MatcherOption {
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "bool_false", keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			return !getBoolValue(ctx, key)
+		}
+		return m
+	}
+}
+
+// WithEnvironment matches when the environment set by SetEnvironment is one of the allowed environments.
+// Environments are compared case-insensitively. Never matches if SetEnvironment hasn't been called.
+func WithEnvironment(allowed ...string) MatcherOption {
+	set := newFoldedSet(allowed)
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "environment", args: []interface{}{allowed}}
+		m.fn = func(ctx context.Context) bool {
+			env := getEnvironment()
+			if env == "" {
+				return false
+			}
+			_, ok := set[strings.ToLower(env)]
+			return ok
+		}
+		return m
+	}
+}
+
+// WithHostname matches when the process's hostname (per os.Hostname, read once) is one of the allowed hostnames.
+// Hostnames are compared case-insensitively. Useful for canarying on specific hosts or pods.
+func WithHostname(allowed ...string) MatcherOption {
+	set := newFoldedSet(allowed)
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "hostname", args: []interface{}{allowed}}
+		m.fn = func(ctx context.Context) bool {
+			_, ok := set[strings.ToLower(getHostname())]
+			return ok
+		}
+		return m
+	}
+}
+
 // WithPercentage enables a feature for a percent of the possible values of a given context key.
-// Uses Go's Fowler–Noll–Vo hash implementation (hash/fnv.New32a).
+// Uses the 32 bit Fowler–Noll–Vo hash (FNV-1a, equivalent to hash/fnv.New32a).
+// Panics if percent is greater than 100.
 func WithPercentage(key Key, percent uint32) MatcherOption {
+	validatePercent(percent)
 	return func(f *Feature) *matcher {
-		m := &matcher{}
+		m := &matcher{kind: "percentage", args: []interface{}{percent}, keys: []Key{key}}
 		m.fn = func(ctx context.Context) bool {
-			h := fnv.New32a()
-			h.Write([]byte(getValue(ctx, key)))
-			return h.Sum32()%100 < percent
+			return bucket(ctx, getValue(ctx, key)) < percent
 		}
 		return m
 	}
 }
+
+// WithPercentageStable is identical to WithPercentage except values are trimmed of surrounding whitespace
+// and lowercased before hashing, so cosmetic differences like " ABC " and "abc" land in the same cohort.
+// Since the normalized value is hashed, cohorts differ from WithPercentage for values that aren't already normalized.
+func WithPercentageStable(key Key, percent uint32) MatcherOption {
+	validatePercent(percent)
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "percentage_stable", args: []interface{}{percent}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			return bucket(ctx, strings.ToLower(strings.TrimSpace(getValue(ctx, key)))) < percent
+		}
+		return m
+	}
+}
+
+// WithPercentageBytes is identical to WithPercentage except it hashes the raw bytes set by WithBytesValue.
+// Useful for binary identifiers such as trace IDs.
+func WithPercentageBytes(key Key, percent uint32) MatcherOption {
+	validatePercent(percent)
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "percentage_bytes", args: []interface{}{percent}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			return hashBytes(getSalt(ctx), getBytesValue(ctx, key))%100 < percent
+		}
+		return m
+	}
+}
+
+// WithPercentageHashFunc is identical to WithPercentage except values are hashed using h.
+// Useful for matching cohorts computed by other systems. The value's bucket is h(value) % 100.
+// Salts set by WithSalt are not applied since they would break consistency with the external hash.
+func WithPercentageHashFunc(key Key, percent uint32, h func([]byte) uint64) MatcherOption {
+	validatePercent(percent)
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "percentage_hash_func", args: []interface{}{percent}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			return h([]byte(getValue(ctx, key)))%100 < uint64(percent)
+		}
+		return m
+	}
+}
+
+// AssignmentStore persists the cohort assignments made by WithStickyPercentage.
+type AssignmentStore interface {
+	// GetAssignment returns the recorded assignment of value for the feature, if any.
+	GetAssignment(ctx context.Context, feature, value string) (enabled bool, present bool, err error)
+	// SetAssignment records the assignment of value for the feature.
+	SetAssignment(ctx context.Context, feature, value string, enabled bool) error
+}
+
+// WithStickyPercentage is identical to WithPercentage except the first assignment of each value is
+// recorded in the store and reused for subsequent evaluations, even if the percentage or hashing changes.
+// Store errors are not fatal: the value's bucket is used instead.
+func WithStickyPercentage(store AssignmentStore, key Key, percent uint32) MatcherOption {
+	validatePercent(percent)
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "sticky_percentage", args: []interface{}{percent}, keys: []Key{key}}
+		m.featFn = func(ctx context.Context, feature string) bool {
+			value := getValue(ctx, key)
+			if enabled, present, err := store.GetAssignment(ctx, feature, value); err == nil && present {
+				return enabled
+			}
+			enabled := bucket(ctx, value) < percent
+			if !isProbe(ctx) {
+				store.SetAssignment(ctx, feature, value, enabled)
+			}
+			return enabled
+		}
+		return m
+	}
+}
+
+// WithPercentageBoundaryWarn is identical to WithPercentage except coalmine_percentage_boundary_total is incremented
+// when the value's bucket is within delta of the percentage, i.e. it would flip if the percentage moved by delta or less.
+// Useful for finding values that are likely to flap near the cohort boundary.
+func WithPercentageBoundaryWarn(key Key, percent, delta uint32) MatcherOption {
+	validatePercent(percent)
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "percentage_boundary_warn", args: []interface{}{percent, delta}, keys: []Key{key}}
+		m.featFn = func(ctx context.Context, feature string) bool {
+			b := bucket(ctx, getValue(ctx, key))
+			if int64(b) >= int64(percent)-int64(delta) && int64(b) < int64(percent)+int64(delta) && !isProbe(ctx) {
+				boundaryMetric.WithLabelValues(feature).Inc()
+			}
+			return b < percent
+		}
+		return m
+	}
+}
+
+// WithPercentageComplement enables a feature for exactly the values that WithPercentage would not
+// given the same key and percent. Useful for splitting traffic into control and treatment groups.
+func WithPercentageComplement(key Key, percent uint32) MatcherOption {
+	validatePercent(percent)
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "percentage_complement", args: []interface{}{percent}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			return bucket(ctx, getValue(ctx, key)) >= percent
+		}
+		return m
+	}
+}
+
+// WithStratifiedPercentage is identical to WithPercentage except the value of stratumKey (i.e. region) is mixed into
+// the hash of unitKey's value, so the percentage applies independently within each stratum rather than globally.
+// Panics if percent is greater than 100.
+func WithStratifiedPercentage(stratumKey, unitKey Key, percent uint32) MatcherOption {
+	validatePercent(percent)
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "stratified_percentage", args: []interface{}{percent}, keys: []Key{stratumKey, unitKey}}
+		m.fn = func(ctx context.Context) bool {
+			return hashPrefixed(getSalt(ctx), getValue(ctx, stratumKey), getValue(ctx, unitKey))%100 < percent
+		}
+		return m
+	}
+}
+
+// now is the clock used by WithDailyPercentage and WithExpiry, replaced in tests.
+var now = time.Now
+
+// WithDailyPercentage is identical to WithPercentage except the current UTC date is mixed into the hash,
+// so a different cohort of values is enabled each day. Cohorts are stable within a day and rotate at midnight UTC.
+// Useful for load testing and chaos experiments that shouldn't always hit the same values.
+func WithDailyPercentage(key Key, percent uint32) MatcherOption {
+	validatePercent(percent)
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "daily_percentage", args: []interface{}{percent}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			date := now().UTC().Format("2006-01-02")
+			return hash(getSalt(ctx)+date, getValue(ctx, key))%100 < percent
+		}
+		return m
+	}
+}
+
+// WithPercentageRange enables a feature for values that hash into buckets lo (inclusive) through hi (exclusive),
+// using the same hash as WithPercentage. Useful for giving independent features disjoint slices of the same population.
+// Panics unless lo is less than hi and hi is no greater than 100.
+func WithPercentageRange(key Key, lo, hi uint32) MatcherOption {
+	if lo >= hi || hi > 100 {
+		panic(fmt.Errorf("coalmine percentage range [%d, %d) is not within 0 and 100", lo, hi))
+	}
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "percentage_range", args: []interface{}{lo, hi}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			b := bucket(ctx, getValue(ctx, key))
+			return b >= lo && b < hi
+		}
+		return m
+	}
+}
+
+// WithWeightedPercentage is similar to WithPercentage except values with a larger numeric weight under weightKey are
+// more likely to be enabled. A value with weight w is enabled with probability 1-(1-percent/100)^w, i.e. as likely as
+// any of w independent draws at the given percentage. So a weight of 1 is enabled at the given percentage, larger weights
+// are enabled more often, and fractional weights less often. Missing or unparseable weights are treated as 1, and values
+// with a weight of 0 or less are never enabled. Cohorts only grow as the percentage or a value's weight increases.
+func WithWeightedPercentage(key, weightKey Key, percent uint32) MatcherOption {
+	validatePercent(percent)
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "weighted_percentage", args: []interface{}{percent}, keys: []Key{key, weightKey}}
+		m.fn = func(ctx context.Context) bool {
+			weight := 1.0
+			if str, present := lookupValue(ctx, weightKey); present {
+				if w, err := strconv.ParseFloat(str, 64); err == nil {
+					weight = w
+				}
+			}
+			if !(weight > 0) {
+				return false
+			}
+			threshold := 1 - math.Pow(1-float64(percent)/100, weight)
+			return float64(mix(hash(getSalt(ctx), getValue(ctx, key))))/(1<<32) < threshold
+		}
+		return m
+	}
+}
+
+// WithPercentageAtLeastOne is identical to WithPercentage except, when percent is greater than 0, at least one of the
+// known values is always enabled. If none of them fall within the percentage, the known value with the lowest bucket
+// is enabled instead. Useful for canaries against small populations (i.e. a handful of tenants).
+// The fallback value is chosen once for unsalted contexts, but on every evaluation outside of the cohort for contexts using WithSalt.
+// Panics if percent is greater than 100.
+func WithPercentageAtLeastOne(key Key, percent uint32, knownValues []string) MatcherOption {
+	validatePercent(percent)
+	known := append([]string(nil), knownValues...)
+	// fallback returns the known value to enable when none of them fall within the percentage
+	fallback := func(salt string) (string, bool) {
+		var lowest string
+		lowestBucket := uint32(100)
+		for _, k := range known {
+			b := BucketOfSalted(salt, k)
+			if b < percent {
+				return "", false // another known value is already enabled
+			}
+			if b < lowestBucket {
+				lowest, lowestBucket = k, b
+			}
+		}
+		return lowest, lowestBucket < 100
+	}
+	unsalted, unsaltedOK := fallback("")
+
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "percentage_at_least_one", args: []interface{}{percent, known}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			value := getValue(ctx, key)
+			if percent == 0 {
+				return false
+			}
+			if bucket(ctx, value) < percent {
+				return true
+			}
+			if salt := getSalt(ctx); salt != "" {
+				lowest, ok := fallback(salt)
+				return ok && value == lowest
+			}
+			return unsaltedOK && value == unsalted
+		}
+		return m
+	}
+}
+
+// WithPercentageList is identical to WithPercentage except values in the never list are always
+// disabled and values in the always list are always enabled. Lists are matched case-insensitively
+// and the never list takes precedence.
+func WithPercentageList(key Key, percent uint32, always, never []string) MatcherOption {
+	validatePercent(percent)
+	alwaysSet, neverSet := newFoldedSet(always), newFoldedSet(never)
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "percentage_list", args: []interface{}{percent, always, never}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			value := getValue(ctx, key)
+			folded := strings.ToLower(value)
+			if _, ok := neverSet[folded]; ok {
+				return false
+			}
+			if _, ok := alwaysSet[folded]; ok {
+				return true
+			}
+			return bucket(ctx, value) < percent
+		}
+		return m
+	}
+}
+
+// WithLeveledPercentage is identical to WithPercentage except the percent depends on the release level
+// set on the context by WithReleaseLevel. The percent of the highest level less than or equal to the current level is used,
+// so shipping higher levels ramps the feature up and rolling back ramps it down.
+// Disabled when the context has no release level or it's lower than every configured level.
+// Panics if any percent is greater than 100.
+func WithLeveledPercentage(key Key, levels map[int64]uint32) MatcherOption {
+	sorted := make([]int64, 0, len(levels))
+	for level, percent := range levels {
+		validatePercent(percent)
+		sorted = append(sorted, level)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percents := make([]uint32, len(sorted))
+	for i, level := range sorted {
+		percents[i] = levels[level]
+	}
+
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "leveled_percentage", args: []interface{}{levels}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			current, ok := getReleaseLevel(ctx)
+			if !ok {
+				return false
+			}
+			i := sort.Search(len(sorted), func(i int) bool { return sorted[i] > current }) - 1
+			if i < 0 {
+				return false
+			}
+			return bucket(ctx, getValue(ctx, key)) < percents[i]
+		}
+		return m
+	}
+}
+
+// WithPercentageNormalized is identical to WithPercentage except denied values are always disabled and the percentage
+// applies to the remaining (eligible) values, so "50" enables roughly half of the eligible values even when the denied
+// values happen to fall within the cohort. Denied values are matched case-insensitively.
+//
+// population is the total number of distinct values, including denied ones. The rollout threshold is raised to
+// compensate for each denied value below it, assuming the eligible values are spread evenly across buckets.
+// Denied values land in different buckets for each salt, so the threshold is computed once per salt (see WithSalt)
+// and cached for up to maxNormalizedSalts salts. Evaluations using salts beyond that recompute it every time.
+// Panics if percent is greater than 100 or population is smaller than the denylist.
+func WithPercentageNormalized(key Key, percent uint32, denied []string, population int) MatcherOption {
+	validatePercent(percent)
+	if population < len(denied) {
+		panic(fmt.Errorf("coalmine population %d is smaller than the denylist (%d)", population, len(denied)))
+	}
+	deniedSet := newFoldedSet(denied)
+	threshold := func(salt string) uint32 {
+		var buckets [100]int
+		for value := range deniedSet {
+			buckets[BucketOfSalted(salt, value)]++
+		}
+		target := float64(percent) / 100 * float64(population-len(deniedSet))
+		var t uint32
+		for below := 0; t < 100 && float64(t)/100*float64(population)-float64(below) < target; t++ {
+			below += buckets[t]
+		}
+		return t
+	}
+	unsalted := threshold("")
+	var (
+		salted     sync.Map // salt -> uint32
+		saltedSize int32
+	)
+	saltedThreshold := func(salt string) uint32 {
+		if val, ok := salted.Load(salt); ok {
+			return val.(uint32)
+		}
+		t := threshold(salt)
+		if atomic.AddInt32(&saltedSize, 1) > maxNormalizedSalts {
+			atomic.AddInt32(&saltedSize, -1)
+		} else if _, loaded := salted.LoadOrStore(salt, t); loaded {
+			atomic.AddInt32(&saltedSize, -1)
+		}
+		return t
+	}
+
+	return func(f *Feature) *matcher {
+		m := &matcher{kind: "percentage_normalized", args: []interface{}{percent, denied, population}, keys: []Key{key}}
+		m.fn = func(ctx context.Context) bool {
+			value := getValue(ctx, key)
+			if _, ok := deniedSet[strings.ToLower(value)]; ok {
+				return false
+			}
+			if salt := getSalt(ctx); salt != "" {
+				return bucket(ctx, value) < saltedThreshold(salt)
+			}
+			return bucket(ctx, value) < unsalted
+		}
+		return m
+	}
+}
+
+// maxNormalizedSalts bounds the number of per-salt thresholds cached by each WithPercentageNormalized matcher.
+const maxNormalizedSalts = 1024
+
+func newFoldedSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		set[strings.ToLower(value)] = struct{}{}
+	}
+	return set
+}
+
+func validatePercent(percent uint32) {
+	if percent > 100 {
+		panic(fmt.Errorf("coalmine percentage %d is not between 0 and 100", percent))
+	}
+}
+
+func bucket(ctx context.Context, value string) uint32 {
+	return BucketOfSalted(getSalt(ctx), value)
+}
+
+// BucketOf returns the bucket (0-99) of a value as computed by WithPercentage, which enables
+// the feature when the bucket is less than the percentage. Useful for explaining cohort membership.
+func BucketOf(value string) uint32 {
+	return BucketOfSalted("", value)
+}
+
+// BucketOfSalted is identical to BucketOf except for contexts using WithSalt.
+func BucketOfSalted(salt, value string) uint32 {
+	return hash(salt, value) % 100
+}
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// mix spreads entropy from the low bits of h into the high bits (murmur3's finalizer), since FNV's high bits are
+// poorly distributed for short, similar values and WithWeightedPercentage scales the whole hash rather than taking a modulus.
+func mix(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// hashBytes is identical to hash but accepts a byte slice value.
+func hashBytes(salt string, value []byte) uint32 {
+	h := hash(salt, "")
+	for i := 0; i < len(value); i++ {
+		h ^= uint32(value[i])
+		h *= fnvPrime32
+	}
+	return h
+}
+
+// hashPrefixed is identical to hash except prefix is hashed as a separate input between the salt and value,
+// so i.e. salt "a" with prefix "bc" and salt "ab" with prefix "c" hash differently.
+// Without a salt, this is equivalent to hash(prefix, value) for any non-empty prefix. An empty prefix still
+// contributes the separator, so hashPrefixed(salt, "", value) is not equivalent to hash(salt, value).
+func hashPrefixed(salt, prefix, value string) uint32 {
+	h := hash(salt, prefix)
+	h *= fnvPrime32 // separator
+	for i := 0; i < len(value); i++ {
+		h ^= uint32(value[i])
+		h *= fnvPrime32
+	}
+	return h
+}
+
+// hash computes the FNV-1a hash of the salt and value without allocating.
+// An empty salt produces the hash of value alone.
+func hash(salt, value string) uint32 {
+	h := uint32(fnvOffset32)
+	if salt != "" {
+		for i := 0; i < len(salt); i++ {
+			h ^= uint32(salt[i])
+			h *= fnvPrime32
+		}
+		h *= fnvPrime32 // separator (xor with 0 is a no-op)
+	}
+	for i := 0; i < len(value); i++ {
+		h ^= uint32(value[i])
+		h *= fnvPrime32
+	}
+	return h
+}
+
+// WithDisabled turns a feature off regardless of its matchers or context values.
+// Overrides (see WithOverride) still apply, so tests can force the feature on.
+func WithDisabled() MatcherOption {
+	return func(f *Feature) *matcher {
+		f.disabled = true
+		return nil
+	}
+}
+
+// WithDefaultEnabled enables a feature when none of its matchers match, making it "on by default".
+// Overrides and WithDisabled still turn it off.
+func WithDefaultEnabled() MatcherOption {
+	return func(f *Feature) *matcher {
+		f.defaultEnabled = true
+		return nil
+	}
+}
+
+// WithExpiry disables a feature at and after t regardless of its matchers, preventing forgotten features from lingering.
+// Overrides still take precedence. The expiry is exported as the coalmine_feature_expiry_timestamp_seconds gauge
+// so alerts can fire as it approaches.
+func WithExpiry(t time.Time) MatcherOption {
+	return func(f *Feature) *matcher {
+		f.expiry = t
+		return nil
+	}
+}
+
+// WithMetricSampling records only a fraction of the feature's enables in the coalmine_feature_enable_total counter,
+// i.e. 0.01 records one in every hundred. Each recorded enable is scaled by 1/rate so the counter still approximates
+// the total. Rates less than or equal to 0 disable the counter for the feature entirely.
+func WithMetricSampling(rate float64) MatcherOption {
+	return func(f *Feature) *matcher {
+		f.metricSampled, f.metricRate = true, math.Min(rate, 1)
+		return nil
+	}
+}
+
+// WithAlias registers previous names of a feature. Overrides set by name (i.e. WithOverrideString)
+// that reference an alias apply to the feature, which eases renames. Aliases are reserved like names,
+// so NewFeature panics if an alias collides with another feature's name or alias.
+func WithAlias(names ...string) MatcherOption {
+	return func(f *Feature) *matcher {
+		f.aliases = append(f.aliases, names...)
+		return nil
+	}
+}
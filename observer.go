@@ -0,0 +1,84 @@
+package coalmine
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type jsonObservation struct {
+	Timestamp time.Time `json:"ts"`
+	Feature   string    `json:"feature"`
+	Enabled   bool      `json:"enabled"`
+}
+
+// JSONObserver returns an ObserverFunc that writes one JSON object per evaluation to w.
+// Writes are serialized, so w doesn't need to be safe for concurrent use.
+func JSONObserver(w io.Writer) ObserverFunc {
+	var mut sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(ctx context.Context, feature string, state bool) {
+		mut.Lock()
+		defer mut.Unlock()
+		enc.Encode(&jsonObservation{Timestamp: time.Now().UTC(), Feature: feature, Enabled: state})
+	}
+}
+
+// SampledObserver returns an ObserverFunc that forwards a fraction of calls to fn, i.e. 0.01 forwards one in every hundred.
+// Sampling is deterministic: a shared counter spaces forwarded calls evenly rather than choosing them at random.
+// Rates less than or equal to 0 forward nothing and rates greater than or equal to 1 forward everything.
+func SampledObserver(rate float64, fn ObserverFunc) ObserverFunc {
+	var count uint64
+	return func(ctx context.Context, feature string, state bool) {
+		if rate <= 0 {
+			return
+		}
+		if rate < 1 {
+			n := atomic.AddUint64(&count, 1)
+			if uint64(float64(n)*rate) == uint64(float64(n-1)*rate) {
+				return
+			}
+		}
+		fn(ctx, feature, state)
+	}
+}
+
+type auditLogKey struct{}
+
+type auditLog struct {
+	mut sync.Mutex
+	enc *json.Encoder
+}
+
+type auditEntry struct {
+	Timestamp time.Time `json:"ts"`
+	Feature   string    `json:"feature"`
+	Reason    Reason    `json:"reason"`
+	Enabled   bool      `json:"enabled"`
+}
+
+// WithAuditLog writes a JSON object to w for every evaluation using the returned context whose
+// state was forced by an override (WithOverride, SetGlobalOverride, or an OverrideLoop) rather than
+// determined by the feature's matchers. Writes are serialized.
+func WithAuditLog(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, auditLogKey{}, &auditLog{enc: json.NewEncoder(w)})
+}
+
+func audit(ctx context.Context, d Decision) {
+	switch d.Reason {
+	case ReasonOverride, ReasonGlobalOverride, ReasonOverrideLoop:
+	default:
+		return
+	}
+	val := ctx.Value(auditLogKey{})
+	if val == nil {
+		return
+	}
+	log := val.(*auditLog)
+	log.mut.Lock()
+	defer log.mut.Unlock()
+	log.enc.Encode(&auditEntry{Timestamp: time.Now().UTC(), Feature: d.Feature, Reason: d.Reason, Enabled: d.State})
+}
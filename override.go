@@ -0,0 +1,101 @@
+package coalmine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// OverrideLoop periodically reads feature overrides from a file, allowing operators to force features
+// on or off at runtime. The file uses the same format as WithOverrideFile, e.g. "feature=on" or "feature=off".
+//
+// Overrides from the loop take precedence over matchers but not over overrides set on the context (i.e. WithOverride).
+type OverrideLoop struct {
+	path     string
+	interval time.Duration
+	onError  func(error)
+
+	mut   sync.RWMutex
+	state map[featureKey]bool
+	notes map[featureKey]string
+}
+
+// NewOverrideLoop allocates an OverrideLoop for the file at path. onError is called with errors
+// encountered while reloading the file, in which case the last good state is retained. It may be nil.
+// Panics if interval isn't positive.
+func NewOverrideLoop(path string, interval time.Duration, onError func(error)) *OverrideLoop {
+	if interval <= 0 {
+		panic(fmt.Errorf("coalmine override loop interval must be positive, got %s", interval))
+	}
+	return &OverrideLoop{
+		path:     path,
+		interval: interval,
+		onError:  onError,
+		state:    map[featureKey]bool{},
+		notes:    map[featureKey]string{},
+	}
+}
+
+// Start reads the file synchronously and then rereads it every interval until ctx is done.
+func (o *OverrideLoop) Start(ctx context.Context) error {
+	if err := o.load(); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(o.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := o.load(); err != nil && o.onError != nil {
+					o.onError(err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (o *OverrideLoop) load() error {
+	state, notes, err := readOverrideFile(o.path)
+	if err != nil {
+		return err
+	}
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	o.state, o.notes = state, notes
+	return nil
+}
+
+func (o *OverrideLoop) get(key featureKey) (bool /* state */, bool /* present */) {
+	o.mut.RLock()
+	defer o.mut.RUnlock()
+	enabled, present := o.state[key]
+	return enabled, present
+}
+
+// Note returns the comment following the feature's override in the file, e.g. "INC-1234" for "checkout=off # INC-1234".
+// Returns an empty string if the feature isn't overridden or its override has no comment.
+func (o *OverrideLoop) Note(feature string) string {
+	o.mut.RLock()
+	defer o.mut.RUnlock()
+	return o.notes[newFeatureKey(feature)]
+}
+
+type overrideLoopKey struct{}
+
+// WithOverrideLoop causes features evaluated using the returned context to honor the loop's overrides.
+func WithOverrideLoop(ctx context.Context, loop *OverrideLoop) context.Context {
+	return context.WithValue(ctx, overrideLoopKey{}, loop)
+}
+
+func getOverrideLoop(ctx context.Context) *OverrideLoop {
+	val := ctx.Value(overrideLoopKey{})
+	if val == nil {
+		return nil
+	}
+	return val.(*OverrideLoop)
+}
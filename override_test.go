@@ -0,0 +1,105 @@
+package coalmine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverrideLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key, value := Key("test-key"), "test-value"
+	f := NewFeature(t.Name(), WithExactMatch(key, value))
+	path := filepath.Join(t.TempDir(), "overrides")
+
+	loop := NewOverrideLoop(path, time.Millisecond*10, func(err error) { t.Error(err) })
+	if err := loop.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ctx = WithOverrideLoop(ctx, loop)
+
+	t.Run("missing file", func(t *testing.T) {
+		assert.False(t, f.Enabled(ctx))
+		assert.True(t, f.Enabled(WithValue(ctx, key, value)))
+	})
+
+	t.Run("force on", func(t *testing.T) {
+		writeOverrides(t, path, t.Name()+"=off\n"+f.name+"=on\n")
+		assert.Eventually(t, func() bool { return f.Enabled(ctx) }, time.Second, time.Millisecond)
+	})
+
+	t.Run("force off", func(t *testing.T) {
+		writeOverrides(t, path, f.name+"=off\n")
+		ctx := WithValue(ctx, key, value)
+		assert.Eventually(t, func() bool { return !f.Enabled(ctx) }, time.Second, time.Millisecond)
+	})
+
+	t.Run("context override wins", func(t *testing.T) {
+		ctx := WithOverride(ctx, f, true)
+		assert.True(t, f.Enabled(ctx))
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		writeOverrides(t, path, "malformed\n")
+		ctx := WithValue(ctx, key, value)
+		assert.Eventually(t, func() bool { return f.Enabled(ctx) }, time.Second, time.Millisecond)
+	})
+}
+
+func TestOverrideLoopNote(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := NewFeature(t.Name(), WithDefaultEnabled())
+	uncommented := NewFeature(t.Name() + "Uncommented")
+	malformed := t.Name() + "Malformed"
+	path := filepath.Join(t.TempDir(), "overrides")
+	writeOverrides(t, path, "# killed during incident response\n"+
+		f.name+"=off # INC-1234 disabled checkout\n"+
+		uncommented.name+" = on\n"+
+		malformed+" # ignored\n")
+
+	loop := NewOverrideLoop(path, time.Hour, func(err error) { t.Error(err) })
+	if err := loop.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ctx = WithOverrideLoop(ctx, loop)
+
+	t.Run("state", func(t *testing.T) {
+		assert.False(t, f.Enabled(ctx))
+		assert.True(t, uncommented.Enabled(ctx))
+	})
+
+	t.Run("note", func(t *testing.T) {
+		assert.Equal(t, "INC-1234 disabled checkout", loop.Note(f.name))
+		assert.Equal(t, "INC-1234 disabled checkout", loop.Note(strings.ToUpper(f.name)))
+	})
+
+	t.Run("no note", func(t *testing.T) {
+		assert.Empty(t, loop.Note(uncommented.name))
+		assert.Empty(t, loop.Note(malformed))
+		assert.Empty(t, loop.Note("missing"))
+	})
+}
+
+func TestOverrideLoopInterval(t *testing.T) {
+	assert.PanicsWithError(t, "coalmine override loop interval must be positive, got 0s", func() { NewOverrideLoop("overrides", 0, nil) })
+	assert.PanicsWithError(t, "coalmine override loop interval must be positive, got -1s", func() { NewOverrideLoop("overrides", -time.Second, nil) })
+}
+
+func writeOverrides(t *testing.T, path, content string) {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
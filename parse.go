@@ -0,0 +1,229 @@
+package coalmine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SyntaxError is returned by ParseMatchers when an expression is invalid.
+type SyntaxError struct {
+	Pos int // byte offset into the expression
+	Msg string
+}
+
+func (s *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", s.Pos, s.Msg)
+}
+
+// ParseMatchers parses a matcher expression such as `region==westus AND customerID%50`.
+//
+// Supported operators, from highest to lowest precedence:
+//
+//	key==value  WithExactMatch(key, value)
+//	key%N       WithPercentage(key, N)
+//	NOT x       WithNOT(x)
+//	x AND y     WithAND(x, y)
+//	x OR y      WithOR(x, y)
+//
+// Parentheses can be used for grouping. Values containing whitespace or operator characters can be double-quoted.
+func ParseMatchers(expr string) (MatcherOption, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, end: len(expr)}
+	opt, err := p.parseOR()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok != nil {
+		return nil, &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %q", tok.text)}
+	}
+	return opt, nil
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenEquals
+	tokenPercent
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lex(expr string) ([]*token, error) {
+	var tokens []*token
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, &token{kind: tokenOpen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, &token{kind: tokenClose, text: ")", pos: i})
+			i++
+		case c == '%':
+			tokens = append(tokens, &token{kind: tokenPercent, text: "%", pos: i})
+			i++
+		case c == '=':
+			if !strings.HasPrefix(expr[i:], "==") {
+				return nil, &SyntaxError{Pos: i, Msg: `expected "=="`}
+			}
+			tokens = append(tokens, &token{kind: tokenEquals, text: "==", pos: i})
+			i += 2
+		case c == '"':
+			end := strings.IndexByte(expr[i+1:], '"')
+			if end == -1 {
+				return nil, &SyntaxError{Pos: i, Msg: "unterminated string"}
+			}
+			tokens = append(tokens, &token{kind: tokenString, text: expr[i+1 : i+1+end], pos: i})
+			i += end + 2
+		default:
+			start := i
+			for i < len(expr) && !strings.ContainsRune(" \t\n\r()%=\"", rune(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, &token{kind: tokenWord, text: expr[start:i], pos: start})
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []*token
+	end    int // length of the expression, used to report errors at EOF
+}
+
+func (p *parser) peek() *token {
+	if len(p.tokens) == 0 {
+		return nil
+	}
+	return p.tokens[0]
+}
+
+func (p *parser) next() *token {
+	tok := p.peek()
+	if tok != nil {
+		p.tokens = p.tokens[1:]
+	}
+	return tok
+}
+
+func (p *parser) peekKeyword(keyword string) bool {
+	tok := p.peek()
+	return tok != nil && tok.kind == tokenWord && tok.text == keyword
+}
+
+func (p *parser) parseOR() (MatcherOption, error) {
+	opts, err := p.parseList("OR", p.parseAND)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts) == 1 {
+		return opts[0], nil
+	}
+	return WithOR(opts...), nil
+}
+
+func (p *parser) parseAND() (MatcherOption, error) {
+	opts, err := p.parseList("AND", p.parseNOT)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts) == 1 {
+		return opts[0], nil
+	}
+	return WithAND(opts...), nil
+}
+
+func (p *parser) parseList(keyword string, operand func() (MatcherOption, error)) ([]MatcherOption, error) {
+	opt, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	opts := []MatcherOption{opt}
+	for p.peekKeyword(keyword) {
+		p.next()
+		opt, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+func (p *parser) parseNOT() (MatcherOption, error) {
+	if !p.peekKeyword("NOT") {
+		return p.parsePrimary()
+	}
+	p.next()
+	opt, err := p.parseNOT()
+	if err != nil {
+		return nil, err
+	}
+	return WithNOT(opt), nil
+}
+
+func (p *parser) parsePrimary() (MatcherOption, error) {
+	tok := p.next()
+	if tok == nil {
+		return nil, &SyntaxError{Pos: p.end, Msg: "unexpected end of expression"}
+	}
+	switch tok.kind {
+	case tokenOpen:
+		opt, err := p.parseOR()
+		if err != nil {
+			return nil, err
+		}
+		closing := p.next()
+		if closing == nil {
+			return nil, &SyntaxError{Pos: p.end, Msg: `expected ")"`}
+		}
+		if closing.kind != tokenClose {
+			return nil, &SyntaxError{Pos: closing.pos, Msg: fmt.Sprintf(`expected ")", got %q`, closing.text)}
+		}
+		return opt, nil
+	case tokenWord, tokenString:
+		return p.parseComparison(Key(tok.text))
+	default:
+		return nil, &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %q", tok.text)}
+	}
+}
+
+func (p *parser) parseComparison(key Key) (MatcherOption, error) {
+	op := p.next()
+	if op == nil {
+		return nil, &SyntaxError{Pos: p.end, Msg: `expected "==" or "%"`}
+	}
+	if op.kind != tokenEquals && op.kind != tokenPercent {
+		return nil, &SyntaxError{Pos: op.pos, Msg: fmt.Sprintf(`expected "==" or "%%", got %q`, op.text)}
+	}
+
+	operand := p.next()
+	if operand == nil {
+		return nil, &SyntaxError{Pos: p.end, Msg: "expected value"}
+	}
+	if operand.kind != tokenWord && operand.kind != tokenString {
+		return nil, &SyntaxError{Pos: operand.pos, Msg: fmt.Sprintf("expected value, got %q", operand.text)}
+	}
+
+	if op.kind == tokenEquals {
+		return WithExactMatch(key, operand.text), nil
+	}
+	percent, err := strconv.ParseUint(operand.text, 10, 32)
+	if err != nil || percent > 100 {
+		return nil, &SyntaxError{Pos: operand.pos, Msg: fmt.Sprintf("invalid percentage %q", operand.text)}
+	}
+	return WithPercentage(key, uint32(percent)), nil
+}
@@ -0,0 +1,77 @@
+package coalmine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMatchers(t *testing.T) {
+	ctx := context.Background()
+	region, customer, tier := Key("region"), Key("customerID"), Key("tier")
+
+	tests := []struct {
+		name     string
+		expr     string
+		values   map[Key]string
+		expected bool
+	}{
+		{"exact match", "region==westus", map[Key]string{region: "westus"}, true},
+		{"exact mismatch", "region==westus", map[Key]string{region: "eastus"}, false},
+		{"quoted value", `region=="west us"`, map[Key]string{region: "west us"}, true},
+		{"percentage in cohort", "customerID%50", map[Key]string{customer: "1"}, true},
+		{"percentage out of cohort", "customerID%50", map[Key]string{customer: "3"}, false},
+		{"AND", "region==westus AND customerID%50", map[Key]string{region: "westus", customer: "1"}, true},
+		{"AND partial", "region==westus AND customerID%50", map[Key]string{region: "westus", customer: "3"}, false},
+		{"OR", "region==westus OR region==eastus", map[Key]string{region: "eastus"}, true},
+		{"NOT", "NOT region==westus", map[Key]string{region: "eastus"}, true},
+		{"double NOT", "NOT NOT region==westus", map[Key]string{region: "westus"}, true},
+		{"AND before OR", "region==westus OR region==eastus AND tier==gold", map[Key]string{region: "westus"}, true},
+		{"AND before OR negative", "region==westus OR region==eastus AND tier==gold", map[Key]string{region: "eastus"}, false},
+		{"NOT before AND", "NOT region==westus AND tier==gold", map[Key]string{region: "eastus", tier: "gold"}, true},
+		{"parentheses", "(region==westus OR region==eastus) AND tier==gold", map[Key]string{region: "westus"}, false},
+		{"parentheses positive", "(region==westus OR region==eastus) AND tier==gold", map[Key]string{region: "westus", tier: "gold"}, true},
+		{"NOT parentheses", "NOT (region==westus OR region==eastus)", map[Key]string{region: "eastus"}, false},
+		{"nested parentheses", "((region==westus))", map[Key]string{region: "westus"}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opt, err := ParseMatchers(tc.expr)
+			require.NoError(t, err)
+
+			f := NewFeature(t.Name(), opt)
+			assert.Equal(t, tc.expected, f.Enabled(WithValues(ctx, tc.values)))
+		})
+	}
+}
+
+func TestParseMatchersErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+	}{
+		{"", 0},
+		{"region", 6},
+		{"region==", 8},
+		{"region=westus", 6},
+		{"region==westus AND", 18},
+		{"region==westus westus", 15},
+		{"(region==westus", 15},
+		{"region==westus)", 14},
+		{"customerID%abc", 11},
+		{"customerID%150", 11},
+		{`region=="westus`, 8},
+		{"region==(westus)", 8},
+		{"AND region==westus", 4},
+	}
+	for _, tc := range tests {
+		t.Run(tc.expr, func(t *testing.T) {
+			_, err := ParseMatchers(tc.expr)
+			if assert.IsType(t, &SyntaxError{}, err) {
+				assert.Equal(t, tc.pos, err.(*SyntaxError).Pos, err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package coalmine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Split partitions the values of key between several mutually exclusive features, e.g. to route 10/10/80
+// percent of traffic between three implementations. Each feature is enabled for its percentage of values
+// and disabled for the rest, regardless of its other matchers (overrides still apply).
+//
+// Percentages must not add up to more than 100. Values left over enable none of the features.
+// The name is mixed into the hash so independent splits of the same key don't line up.
+// Split must be called before the features are evaluated, typically right after they're allocated.
+func Split(name string, key Key, features map[*Feature]uint32) {
+	sorted := make([]*Feature, 0, len(features))
+	var total uint32
+	for f, percent := range features {
+		sorted = append(sorted, f)
+		total += percent
+	}
+	if total > 100 {
+		panic(fmt.Errorf("coalmine split %q adds up to %d percent, which is greater than 100", name, total))
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+
+	var lo uint32
+	for _, f := range sorted {
+		hi := lo + features[f]
+		f.addGate(newSplitMatcher(name, key, lo, hi))
+		m := newSplitMatcher(name, key, lo, hi)
+		matchers := f.getMatchers()
+		m.setIndex(f.name, strconv.Itoa(len(matchers)))
+		f.matchers.Store(append(matchers[:len(matchers):len(matchers)], m))
+		lo = hi
+	}
+}
+
+func newSplitMatcher(name string, key Key, lo, hi uint32) *matcher {
+	m := &matcher{kind: "split", args: []interface{}{name, lo, hi}, keys: []Key{key}}
+	m.fn = func(ctx context.Context) bool {
+		b := hashPrefixed(getSalt(ctx), name, getValue(ctx, key)) % 100
+		return lo <= b && b < hi
+	}
+	return m
+}
@@ -0,0 +1,137 @@
+package coalmine
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// TagError is returned by RegisterStruct when a struct field's coalmine tag is invalid.
+type TagError struct {
+	Field string
+	Msg   string
+}
+
+func (t *TagError) Error() string {
+	return fmt.Sprintf("invalid coalmine tag on field %s: %s", t.Field, t.Msg)
+}
+
+var featurePtrType = reflect.TypeOf((*Feature)(nil))
+
+// RegisterStruct allocates a feature for each *Feature field of the struct pointed to by v that has a coalmine tag.
+// The tag holds the feature's name followed by comma-separated options, e.g. `coalmine:"checkout,percentage=region:50"`.
+//
+// Supported options:
+//
+//	exact=key:value   WithExactMatch(key, value)
+//	percentage=key:N  WithPercentage(key, N)
+//	expr=expression   ParseMatchers(expression)
+//	default_enabled   WithDefaultEnabled()
+//	disabled          WithDisabled()
+//
+// Untagged fields are ignored. Every tag is validated before any feature is registered, so no features are
+// registered when an error is returned.
+func RegisterStruct(v interface{}) error {
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() || ptr.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("coalmine RegisterStruct requires a non-nil pointer to a struct, got %T", v)
+	}
+	val := ptr.Elem()
+
+	type field struct {
+		index int
+		name  string
+		opts  []MatcherOption
+	}
+	var fields []field
+	seen := map[string]string{}
+	for i := 0; i < val.NumField(); i++ {
+		sf := val.Type().Field(i)
+		tag, ok := sf.Tag.Lookup("coalmine")
+		if !ok {
+			continue
+		}
+		if sf.Type != featurePtrType {
+			return &TagError{Field: sf.Name, Msg: fmt.Sprintf("field must be a *Feature, got %s", sf.Type)}
+		}
+		if sf.PkgPath != "" {
+			return &TagError{Field: sf.Name, Msg: "field must be exported"}
+		}
+		name, opts, err := parseFeatureTag(tag)
+		if err != nil {
+			return &TagError{Field: sf.Name, Msg: err.Error()}
+		}
+		if other, ok := seen[strings.ToLower(name)]; ok {
+			return &TagError{Field: sf.Name, Msg: fmt.Sprintf("name %q is also used by field %s", name, other)}
+		}
+		if lookupFeature(name) != nil {
+			return &TagError{Field: sf.Name, Msg: fmt.Sprintf("a coalmine feature with the name %q already exists", name)}
+		}
+		if _, ok := definedKeys.Load(strings.ToLower(name)); ok {
+			return &TagError{Field: sf.Name, Msg: fmt.Sprintf("a coalmine key with the name %q already exists", name)}
+		}
+		seen[strings.ToLower(name)] = sf.Name
+		fields = append(fields, field{index: i, name: name, opts: opts})
+	}
+
+	for _, f := range fields {
+		val.Field(f.index).Set(reflect.ValueOf(NewFeature(f.name, f.opts...)))
+	}
+	return nil
+}
+
+func parseFeatureTag(tag string) (string, []MatcherOption, error) {
+	chunks := strings.Split(tag, ",")
+	name := strings.TrimSpace(chunks[0])
+	if name == "" {
+		return "", nil, fmt.Errorf("missing feature name")
+	}
+
+	var opts []MatcherOption
+	for _, chunk := range chunks[1:] {
+		option, arg := strings.TrimSpace(chunk), ""
+		if i := strings.Index(option, "="); i >= 0 {
+			option, arg = option[:i], option[i+1:]
+		}
+		switch option {
+		case "default_enabled":
+			opts = append(opts, WithDefaultEnabled())
+		case "disabled":
+			opts = append(opts, WithDisabled())
+		case "exact":
+			key, value, ok := splitTagArg(arg)
+			if !ok {
+				return "", nil, fmt.Errorf("exact requires key:value, got %q", arg)
+			}
+			opts = append(opts, WithExactMatch(Key(key), value))
+		case "percentage":
+			key, value, ok := splitTagArg(arg)
+			if !ok {
+				return "", nil, fmt.Errorf("percentage requires key:N, got %q", arg)
+			}
+			percent, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || percent > 100 {
+				return "", nil, fmt.Errorf("percentage %q is not between 0 and 100", value)
+			}
+			opts = append(opts, WithPercentage(Key(key), uint32(percent)))
+		case "expr":
+			opt, err := ParseMatchers(arg)
+			if err != nil {
+				return "", nil, err
+			}
+			opts = append(opts, opt)
+		default:
+			return "", nil, fmt.Errorf("unknown option %q", option)
+		}
+	}
+	return name, opts, nil
+}
+
+func splitTagArg(arg string) (string, string, bool) {
+	i := strings.Index(arg, ":")
+	if i <= 0 {
+		return "", "", false
+	}
+	return arg[:i], arg[i+1:], true
+}
@@ -0,0 +1,93 @@
+package coalmine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterStruct(t *testing.T) {
+	ctx := context.Background()
+	region, tier := Key("region"), Key("tier")
+
+	var features struct {
+		Checkout *Feature `coalmine:"TestRegisterStructCheckout,exact=region:westus"`
+		Search   *Feature `coalmine:"TestRegisterStructSearch,percentage=tier:100"`
+		Expr     *Feature `coalmine:"TestRegisterStructExpr,expr=region==eastus AND tier==gold"`
+		Default  *Feature `coalmine:"TestRegisterStructDefault,default_enabled"`
+		Disabled *Feature `coalmine:"TestRegisterStructDisabled,default_enabled,disabled"`
+		Untagged *Feature
+	}
+	require.NoError(t, RegisterStruct(&features))
+
+	assert.True(t, features.Checkout.Enabled(WithValue(ctx, region, "westus")))
+	assert.False(t, features.Checkout.Enabled(WithValue(ctx, region, "eastus")))
+	assert.True(t, features.Search.Enabled(WithValue(ctx, tier, "anything")))
+	assert.True(t, features.Expr.Enabled(WithValues(ctx, map[Key]string{region: "eastus", tier: "gold"})))
+	assert.False(t, features.Expr.Enabled(WithValue(ctx, region, "eastus")))
+	assert.True(t, features.Default.Enabled(ctx))
+	assert.False(t, features.Disabled.Enabled(ctx))
+	assert.Nil(t, features.Untagged)
+	assert.Same(t, features.Checkout, lookupFeature("TestRegisterStructCheckout"))
+}
+
+func TestRegisterStructErrors(t *testing.T) {
+	NewFeature(t.Name() + "Existing")
+
+	tests := []struct {
+		name string
+		v    interface{}
+		err  string
+	}{
+		{"not a pointer", struct{}{}, "coalmine RegisterStruct requires a non-nil pointer to a struct, got struct {}"},
+		{"nil pointer", (*struct{})(nil), "coalmine RegisterStruct requires a non-nil pointer to a struct, got *struct {}"},
+		{"wrong field type", &struct {
+			F bool `coalmine:"a"`
+		}{}, "invalid coalmine tag on field F: field must be a *Feature, got bool"},
+		{"unexported", &struct {
+			f *Feature `coalmine:"a"`
+		}{}, "invalid coalmine tag on field f: field must be exported"},
+		{"missing name", &struct {
+			F *Feature `coalmine:",disabled"`
+		}{}, "invalid coalmine tag on field F: missing feature name"},
+		{"unknown option", &struct {
+			F *Feature `coalmine:"a,sometimes"`
+		}{}, `invalid coalmine tag on field F: unknown option "sometimes"`},
+		{"malformed percentage", &struct {
+			F *Feature `coalmine:"a,percentage=50"`
+		}{}, `invalid coalmine tag on field F: percentage requires key:N, got "50"`},
+		{"invalid percentage", &struct {
+			F *Feature `coalmine:"a,percentage=tier:101"`
+		}{}, `invalid coalmine tag on field F: percentage "101" is not between 0 and 100`},
+		{"malformed exact", &struct {
+			F *Feature `coalmine:"a,exact=:westus"`
+		}{}, `invalid coalmine tag on field F: exact requires key:value, got ":westus"`},
+		{"invalid expression", &struct {
+			F *Feature `coalmine:"a,expr=region=="`
+		}{}, "invalid coalmine tag on field F: syntax error at position 8: expected value"},
+		{"duplicate within struct", &struct {
+			A *Feature `coalmine:"a"`
+			B *Feature `coalmine:"A"`
+		}{}, `invalid coalmine tag on field B: name "A" is also used by field A`},
+		{"already registered", &struct {
+			F *Feature `coalmine:"TestRegisterStructErrorsExisting"`
+		}{}, `invalid coalmine tag on field F: a coalmine feature with the name "TestRegisterStructErrorsExisting" already exists`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.EqualError(t, RegisterStruct(tc.v), tc.err)
+		})
+	}
+
+	t.Run("nothing registered on error", func(t *testing.T) {
+		var features struct {
+			A *Feature `coalmine:"TestRegisterStructErrorsPartial"`
+			B *Feature `coalmine:"b,unknown"`
+		}
+		assert.Error(t, RegisterStruct(&features))
+		assert.Nil(t, features.A)
+		assert.Nil(t, lookupFeature("TestRegisterStructErrorsPartial"))
+	})
+}
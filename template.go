@@ -0,0 +1,27 @@
+package coalmine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// FuncMap returns template functions for evaluating the given features against ctx. The `enabled` function takes a
+// feature name (case-insensitive) and returns its state, i.e. `{{if enabled "checkout"}}...{{end}}`. Execution fails
+// if the feature wasn't provided. Convert the result to html/template.FuncMap for use with HTML templates.
+func FuncMap(ctx context.Context, features ...*Feature) template.FuncMap {
+	byName := make(map[string]*Feature, len(features))
+	for _, f := range features {
+		byName[strings.ToLower(f.name)] = f
+	}
+	return template.FuncMap{
+		"enabled": func(name string) (bool, error) {
+			f, ok := byName[strings.ToLower(name)]
+			if !ok {
+				return false, fmt.Errorf("coalmine feature %q was not provided to FuncMap", name)
+			}
+			return f.Enabled(ctx), nil
+		},
+	}
+}